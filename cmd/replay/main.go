@@ -0,0 +1,148 @@
+// replay rebuilds a game recorded with the server's -record flag.
+//
+// By default it seeks to the requested tick and prints the state there.
+// With -play it starts from the beginning unless -seek is given and writes the same RPC protocol as the server on stdout so it can be fed to the zig client instead of game-server.
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Jorropo/OpenAirways/replay"
+	rpcrender "github.com/Jorropo/OpenAirways/rpc/render"
+	"github.com/Jorropo/OpenAirways/state"
+)
+
+func main() {
+	if err := mainRet(); err != nil {
+		fmt.Fprintf(os.Stderr, "replay error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func mainRet() error {
+	var inPath, exportPath string
+	var seek int64
+	var play bool
+	var speed float64
+	flag.StringVar(&inPath, "in", "", "replay file to read")
+	flag.Int64Var(&seek, "seek", -1, "tick to seek to, negative means the end of the replay, with -play it defaults to the start")
+	flag.StringVar(&exportPath, "export", "", "write the state at the seeked tick to this file in wire format")
+	flag.BoolVar(&play, "play", false, "after seeking, play the rest of the replay to stdout for the zig client")
+	flag.Float64Var(&speed, "speed", 1, "playback speed multiplier for -play, 0 plays as fast as possible")
+	flag.Parse()
+	var seekSet bool
+	flag.Visit(func(f *flag.Flag) { seekSet = seekSet || f.Name == "seek" })
+
+	if inPath == "" {
+		return fmt.Errorf("missing -in")
+	}
+	if speed < 0 {
+		return fmt.Errorf("negative -speed")
+	}
+
+	f, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := replay.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("reading replay: %w", err)
+	}
+	log.Printf("replay recorded by %q on map %q starting at tick %d", r.Meta.Version, r.Meta.Map, r.Initial.Now)
+
+	var s state.State
+	s.Copy(&r.Initial)
+	if play && !seekSet {
+		seek = int64(s.Now) // play everything
+	}
+	if seek >= 0 && state.Time(seek) < s.Now {
+		return fmt.Errorf("cannot seek to %d, replay starts at %d", seek, s.Now)
+	}
+
+	var ended bool
+	for seek < 0 || s.Now < state.Time(seek) {
+		t, err := r.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				ended = true
+				break
+			}
+			return fmt.Errorf("reading tick %d: %w", s.Now, err)
+		}
+		logPlayers(t)
+		t.Apply(&s)
+	}
+	if ended && seek >= 0 {
+		return fmt.Errorf("cannot seek to %d, replay ends at %d", seek, s.Now)
+	}
+
+	if exportPath != "" {
+		if err := os.WriteFile(exportPath, s.AppendMarshalBinary(nil), 0o644); err != nil {
+			return fmt.Errorf("exporting state: %w", err)
+		}
+	}
+
+	if !play {
+		printState(&s)
+		return nil
+	}
+	if ended {
+		return nil
+	}
+
+	render := rpcrender.New(os.Stdout)
+	render.Render(&s, func() {})
+	var waitPerTick time.Duration
+	if speed != 0 {
+		waitPerTick = time.Duration(float64(time.Second/state.TickRate) / speed)
+	}
+	start := time.Now()
+	for {
+		t, err := r.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("reading tick %d: %w", s.Now, err)
+		}
+		logPlayers(t)
+		t.Apply(&s)
+
+		// Use the same drift free timing as the server so zig's extrapolation stays smooth.
+		start = start.Add(waitPerTick)
+		time.Sleep(time.Until(start))
+		render.Render(&s, func() {})
+	}
+}
+
+func logPlayers(t *replay.Tick) {
+	for _, p := range t.Joined {
+		log.Printf("tick %d: player %d joined %s", t.Now, p.ID, p.Peer)
+	}
+	for _, id := range t.Left {
+		log.Printf("tick %d: player %d left", t.Now, id)
+	}
+}
+
+func printState(s *state.State) {
+	fmt.Printf("tick: %d\n", s.Now)
+	fmt.Printf("state hash: %x\n", sha256.Sum256(s.AppendMarshalBinary(nil)))
+	fmt.Printf("runways: %d\n", len(s.Runways))
+	for _, r := range s.Runways {
+		fmt.Printf("\tid: %d pos: %d,%d heading: %d\n", r.ID, r.Pos.X, r.Pos.Y, r.Heading)
+	}
+	fmt.Printf("planes: %d\n", len(s.Planes))
+	for _, p := range s.Planes {
+		pos, heading := p.Position(s.Now)
+		fmt.Printf("\tid: %d pos: %d,%d heading: %d want heading: %d commanded by: %d\n", p.ID, pos.X, pos.Y, heading, p.WantHeading, p.CommandedBy)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Jorropo/OpenAirways/netcode"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const adminHelp = `commands:
+	players            list the connected players
+	kick <player>      disconnect a player and tell it to not reconnect
+	ban <player|peer>  kick a player and refuse it's peer for the rest of the session
+	resync <player>    make a player reconnect to get a fresh copy of the game
+`
+
+// serveAdmin answers the commands of local admins connecting to l, one command per line.
+// Each answer ends with a line saying "ok" or starting with "error:".
+func serveAdmin(l net.Listener, n *netcode.Netcode) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Println("admin listener:", err)
+			return
+		}
+		go func() {
+			defer c.Close()
+			s := bufio.NewScanner(c)
+			for s.Scan() {
+				out, err := adminCommand(n, strings.Fields(s.Text()))
+				if err != nil {
+					fmt.Fprintln(c, "error:", err)
+					continue
+				}
+				fmt.Fprint(c, out)
+				fmt.Fprintln(c, "ok")
+			}
+		}()
+	}
+}
+
+func adminCommand(n *netcode.Netcode, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", nil
+	}
+	switch args[0] {
+	case "help":
+		return adminHelp, nil
+	case "players":
+		names := make(map[uint32]string)
+		for _, e := range n.Roster() {
+			names[e.ID] = e.Name
+		}
+		var b strings.Builder
+		for _, r := range n.Stats().Remotes {
+			role := "player"
+			if r.Spectator {
+				role = "spectator"
+			}
+			fmt.Fprintf(&b, "%d\t%s\t%s\t%q\trtt: %v\n", r.ID, role, r.Peer, names[r.ID], r.RTT)
+		}
+		return b.String(), nil
+	case "kick", "resync":
+		if len(args) != 2 {
+			return "", fmt.Errorf("usage: %s <player>", args[0])
+		}
+		id, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return "", fmt.Errorf("parsing player id: %w", err)
+		}
+		if args[0] == "kick" {
+			return "", n.Kick(uint32(id))
+		}
+		return "", n.Resync(uint32(id))
+	case "ban":
+		if len(args) != 2 {
+			return "", fmt.Errorf("usage: ban <player|peer>")
+		}
+		if id, err := strconv.ParseUint(args[1], 10, 32); err == nil {
+			for _, r := range n.Stats().Remotes {
+				if r.ID == uint32(id) {
+					return "", n.Ban(r.Peer)
+				}
+			}
+			return "", fmt.Errorf("player %d is not connected", id)
+		}
+		p, err := peer.Decode(args[1])
+		if err != nil {
+			return "", fmt.Errorf("parsing peer id: %w", err)
+		}
+		return "", n.Ban(p)
+	default:
+		return "", fmt.Errorf("unknown command %q, try help", args[0])
+	}
+}
@@ -2,16 +2,23 @@ package main
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/Jorropo/OpenAirways/mesh"
 	"github.com/Jorropo/OpenAirways/netcode"
+	"github.com/Jorropo/OpenAirways/netsim"
+	"github.com/Jorropo/OpenAirways/replay"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -19,9 +26,13 @@ import (
 	"github.com/multiformats/go-multiaddr"
 
 	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+	rpcrender "github.com/Jorropo/OpenAirways/rpc/render"
 	"github.com/Jorropo/OpenAirways/state"
 )
 
+// passwordEnv holds the room password when -password is not given, arguments can be read by anyone on the machine.
+const passwordEnv = "OPENAIRWAYS_PASSWORD"
+
 func main() {
 	if err := mainRet(); err != nil {
 		fmt.Fprintf(os.Stderr, "go server error: %v\n", err)
@@ -32,9 +43,90 @@ func main() {
 func mainRet() error {
 	var targetStr string
 	var debugStartClients uint
+	var recordPath string
+	var logStats time.Duration
+	var maxSendBacklog uint64
+	var maxCommitLag uint
+	var readTimeout, writeTimeout, heartbeat, ping, clockSync time.Duration
+	var meshAddr string
+	var meshLoss float64
+	var netsimSpec string
+	var debugClientNetsim []string
+	var name string
+	var ready bool
+	var lobby uint
+	var chatRate float64
+	var chatBurst uint
+	var chatHistory int
+	var resumeDelay uint
+	var spectate bool
+	var ownership bool
+	var adminPath string
+	var password string
+	var allowed []peer.ID
 	flag.StringVar(&targetStr, "target", "", "target multiaddr to connect to, leave empty for server")
 	flag.UintVar(&debugStartClients, "debug-start-clients", 0, "start this many clients locally")
+	flag.StringVar(&recordPath, "record", "", "write a replay of the game to this file, server only")
+	flag.DurationVar(&logStats, "log-stats", 0, "log netcode statistics at this interval, zero disables")
+	flag.Uint64Var(&maxSendBacklog, "max-send-backlog", netcode.DefaultMaxSendBacklog, "disconnect peers with more than this many packets waiting to be sent to them")
+	flag.UintVar(&maxCommitLag, "max-commit-lag", netcode.DefaultMaxCommitLag, "disconnect peers blocking commits for more than this many ticks")
+	flag.DurationVar(&readTimeout, "read-timeout", netcode.DefaultReadTimeout, "disconnect peers we did not receive anything from for this long, zero disables")
+	flag.DurationVar(&writeTimeout, "write-timeout", netcode.DefaultWriteTimeout, "disconnect peers when writing to them blocks for this long, zero disables")
+	flag.DurationVar(&heartbeat, "heartbeat", netcode.DefaultHeartbeatInterval, "send a heartbeat to peers we did not write anything to for this long, zero disables")
+	flag.DurationVar(&ping, "ping", netcode.DefaultPingInterval, "measure the round trip time to peers at this interval, zero disables")
+	flag.DurationVar(&clockSync, "clock-sync", netcode.DefaultClockSyncInterval, "report our live tick to clients at this interval so they correct their clock drift, server only, zero disables")
+	flag.StringVar(&meshAddr, "mesh", "", "join the unreliable mesh with other clients listening on this UDP address (like 0.0.0.0:0), client only, empty disables")
+	flag.Float64Var(&meshLoss, "mesh-loss", 0, "drop this fraction of the datagrams we send over the mesh, for testing")
+	flag.StringVar(&netsimSpec, "netsim", "", "simulate network conditions on our game streams, like delay=50ms,jitter=10ms,dist=normal,loss=0.01,late=0.05,bandwidth=64000,stall=2s/30s")
+	flag.Func("debug-client-netsim", "-netsim for the debug clients, repeat it to give them different conditions, the last one is reused for the remaining clients", func(s string) error {
+		if _, err := netsim.Parse(s); err != nil {
+			return err
+		}
+		debugClientNetsim = append(debugClientNetsim, s)
+		return nil
+	})
+	flag.StringVar(&name, "name", "", "our name in the roster")
+	flag.BoolVar(&ready, "ready", false, "be ready to start the game right away")
+	flag.UintVar(&lobby, "lobby", 0, "wait in a lobby until this many players, us included, joined and everyone is ready before starting the game, server only, zero disables")
+	flag.Float64Var(&chatRate, "chat-rate", netcode.DefaultChatRate, "chat messages per second players can send on average, server only, zero disables the limit")
+	flag.UintVar(&chatBurst, "chat-burst", netcode.DefaultChatBurst, "chat messages players can send in a row, server only")
+	flag.IntVar(&chatHistory, "chat-history", netcode.DefaultChatHistory, "send the latest this many chat messages to players joining, server only")
+	flag.UintVar(&resumeDelay, "resume-delay", netcode.DefaultResumeDelay, "ticks everyone waits before the game restarts when we resume it, capped to "+fmt.Sprint(netcode.MaxResumeDelay))
+	flag.BoolVar(&spectate, "spectate", false, "watch the game without playing, client only")
+	flag.BoolVar(&ownership, "ownership", false, "split the planes between the players, only a plane's owner can command it, server only")
+	flag.StringVar(&adminPath, "admin", "", "listen for admin commands like kick, ban and resync on this unix socket, server only, empty disables")
+	flag.StringVar(&password, "password", "", "room password, on the server players must give the same one to join, $"+passwordEnv+" is used when empty so it stays out of the process list")
+	flag.Func("allow", "only let this peer id join, repeat it to allow more peers, server only", func(s string) error {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return err
+		}
+		allowed = append(allowed, id)
+		return nil
+	})
+	flag.Func("allow-file", "only let the peer ids listed in this file join, one per line, lines starting with # are ignored, server only", func(path string) error {
+		ids, err := readPeerList(path)
+		if err != nil {
+			return err
+		}
+		if allowed == nil {
+			allowed = []peer.ID{} // an empty file allows nobody rather than everyone
+		}
+		allowed = append(allowed, ids...)
+		return nil
+	})
 	flag.Parse()
+	if password == "" {
+		password = os.Getenv(passwordEnv)
+	}
+
+	conditions, err := netsim.Parse(netsimSpec)
+	if err != nil {
+		return fmt.Errorf("parsing -netsim: %w", err)
+	}
+	if !conditions.IsZero() {
+		log.Println("simulating network conditions:", conditions)
+	}
 
 	opts := []libp2p.Option{
 		libp2p.Transport(tcp.NewTCPTransport), // only use TCP because we are using the linux process teardown to close the connection and QUIC runs in userland, could be changed.
@@ -68,6 +160,10 @@ func mainRet() error {
 	if err != nil {
 		return fmt.Errorf("creating host: %w", err)
 	}
+	defer h.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	if debugStartClients > 0 {
 		var laddr multiaddr.Multiaddr
@@ -81,8 +177,16 @@ func mainRet() error {
 	startClients:
 		{
 			id := laddr.String() + "/p2p/" + h.ID().String()
-			for range debugStartClients {
-				cmd := exec.Command("./zig-out/bin/OpenAirways", "-target", id)
+			for i := range int(debugStartClients) {
+				args := []string{"-target", id, "-name", fmt.Sprintf("debug %d", i)}
+				if lobby != 0 {
+					args = append(args, "-ready") // they can't be told to be ready otherwise
+				}
+				if len(debugClientNetsim) != 0 {
+					args = append(args, "-netsim", debugClientNetsim[min(i, len(debugClientNetsim)-1)])
+				}
+				cmd := exec.Command("./zig-out/bin/OpenAirways", args...)
+				cmd.Env = append(os.Environ(), passwordEnv+"="+password) // zig passes it's environment to the go client.
 				cmd.Stdout = os.Stderr
 				cmd.Stderr = os.Stderr
 				err := cmd.Start()
@@ -120,159 +224,174 @@ couldntStartClients:
 	}()
 
 	if targetStr != "" {
-		err = h.Connect(context.TODO(), info)
+		err = h.Connect(ctx, info)
 		if err != nil {
 			return fmt.Errorf("connecting to server: %w", err)
 		}
 	}
 
-	n, err := netcode.New(h, makeRenderCallback(), info.ID)
-	if err != nil {
-		return fmt.Errorf("setting up netcode: %w", err)
+	nopts := []netcode.Option{
+		netcode.MaxSendBacklog(maxSendBacklog),
+		netcode.MaxCommitLag(state.Time(maxCommitLag)),
+		netcode.ReadTimeout(readTimeout),
+		netcode.WriteTimeout(writeTimeout),
+		netcode.HeartbeatInterval(heartbeat),
+		netcode.PingInterval(ping),
+		netcode.ClockSyncInterval(clockSync),
+		netcode.SimulateNetwork(conditions),
+		netcode.ChatRateLimit(chatRate, chatBurst),
+		netcode.ChatHistory(chatHistory),
+		netcode.ResumeDelay(state.Time(resumeDelay)),
 	}
-
-	var cmd rpcgame.Command
-	for {
-		_, err := io.ReadFull(os.Stdin, cmd[:2])
+	if lobby != 0 {
+		nopts = append(nopts, netcode.Lobby(uint32(lobby)))
+	}
+	if spectate {
+		nopts = append(nopts, netcode.Spectate())
+	}
+	if ownership {
+		nopts = append(nopts, netcode.Ownership())
+	}
+	if password != "" {
+		nopts = append(nopts, netcode.Password(password))
+	}
+	if allowed != nil {
+		nopts = append(nopts, netcode.AllowPeers(allowed...))
+	}
+	if meshAddr != "" {
+		c, err := mesh.Listen(meshAddr)
 		if err != nil {
-			return fmt.Errorf("reading header from zig: %v", err)
+			return fmt.Errorf("listening for the mesh: %w", err)
 		}
-
-		op := cmd.OpCode()
-		sz, ok := op.Size()
-		if !ok {
-			return fmt.Errorf("unknown opcode from zig: %v", op)
+		defer c.Close()
+		if meshLoss > 0 {
+			c = mesh.Lossy(c, meshLoss)
 		}
-
-		_, err = io.ReadFull(os.Stdin, cmd[2:sz])
+		nopts = append(nopts, netcode.UnreliableMesh(c))
+	}
+	if recordPath != "" {
+		f, err := os.Create(recordPath)
 		if err != nil {
-			return fmt.Errorf("reading payload from zig: %v", err)
+			return fmt.Errorf("creating replay file: %w", err)
 		}
-
-		n.Act(cmd)
+		defer f.Close()
+		nopts = append(nopts, netcode.Record(f, replay.Metadata{
+			Version: string(netcode.Proto),
+			Map:     "random",
+		}))
 	}
-}
-
-func makeRenderCallback() func(*state.State, func()) {
-	var hasDoneInit bool
-	var sendReuse []byte
-	var oldCamera state.Rect
-
-	return func(s *state.State, unlock func()) {
-		content := sendReuse[:0]
-		if !hasDoneInit {
-			hasDoneInit = true
-			// Send game init packet
-			size := 2 + // OpCode
-				4 + // TickRate
-				1 + // SubPixel
-				4 + // speed
-				4*4 + // map size
-				4*4 + // visible map area
-				1 + // len(Runways)
-				(1+ // id
-					4*2+ // pos
-					2)* // heading
-					uint(len(s.Runways))
-
-			content = makeBuffer(content, size)
-			b := content
-			b = u16(b, uint16(rpcgame.GameInit))
-			b = u32(b, uint32(state.TickRate))
-			b[0] = state.SubPixel
-			b = b[1:]
-			b = u32(b, uint32(state.Speed))
-			b = rect(b, s.MapSize)
-			b = rect(b, s.CameraSize)
-			b[0] = uint8(len(s.Runways))
-			b = b[1:]
-			for _, a := range s.Runways {
-				b[0] = a.ID
-				b = b[1:]
-				b = v2(b, a.Pos)
-				b = u16(b, uint16(a.Heading))
-			}
-
-			oldCamera = s.CameraSize
-		}
 
-		size := 2 + // OpCode
-			4 + // Now
-			4 + // len(Planes)
-			(4+ // id
-				4*2+ // pos
-				2+ // wantHeading
-				2)* // heading
-				uint(len(s.Planes))
-		content, b := appendNewBufferAfter(content, size)
-
-		b = u16(b, uint16(rpcgame.StateUpdate))
-		b = u32(b, uint32(s.Now))
-		b = u32(b, uint32(len(s.Planes)))
-		for _, p := range s.Planes {
-			b = u32(b, p.ID)
-			pos, heading := p.Position(s.Now)
-			b = v2(b, pos)
-			b = u16(b, uint16(p.WantHeading))
-			b = u16(b, uint16(heading))
-		}
-
-		if oldCamera != s.CameraSize {
-			oldCamera = s.CameraSize
-			content, b = appendNewBufferAfter(b, 18)
-			b = u16(b, uint16(rpcgame.MapResize))
-			b = rect(b, oldCamera)
-		}
-		unlock()
+	n, err := netcode.New(ctx, h, rpcrender.New(os.Stdout), info.ID, nopts...)
+	if err != nil {
+		return fmt.Errorf("setting up netcode: %w", err)
+	}
 
-		sendReuse = content
-		_, err := os.Stdout.Write(content)
+	if adminPath != "" {
+		l, err := net.Listen("unix", adminPath)
 		if err != nil {
-			log.Fatalf("writing to zig client: %s", err)
+			return fmt.Errorf("listening for admin commands: %w", err)
 		}
+		defer l.Close()
+		go serveAdmin(l, n)
 	}
-}
-
-func u8(b []byte, x uint16) []byte {
-	binary.LittleEndian.PutUint16(b, x)
-	return b[2:]
-}
-
-func u16(b []byte, x uint16) []byte {
-	binary.LittleEndian.PutUint16(b, x)
-	return b[2:]
-}
 
-func u32(b []byte, x uint32) []byte {
-	binary.LittleEndian.PutUint32(b, x)
-	return b[4:]
-}
+	if err := n.SetName(name); err != nil {
+		return fmt.Errorf("setting name: %w", err)
+	}
+	n.SetReady(ready)
+
+	if logStats > 0 {
+		go func() {
+			for range time.Tick(logStats) {
+				s := n.Stats()
+				r := s.Rollback
+				log.Printf("rollbacks: %d replayed ticks: %d duplicates: %d unreliable discarded: %d unreliable expired: %d commit-live distance: %d join length: %d send queue: %d commit queue: %d received: %d in %d batches chat dropped: %d",
+					r.Rollbacks, r.ReplayedTicks, r.Duplicates, r.UnreliableDiscarded, r.UnreliableExpired, r.Distance, r.JoinLength, s.SendQueue, s.CommitQueue, s.ReceivedCommands, s.ReceiveBatches, s.ChatDropped)
+				if m := s.Mesh; m.Peers != 0 || m.Sent != 0 || m.Received != 0 {
+					log.Printf("\tmesh peers: %d sent: %d received: %d invalid: %d", m.Peers, m.Sent, m.Received, m.Invalid)
+				}
+				for _, p := range s.Remotes {
+					role := "peer"
+					if p.Spectator {
+						role = "spectator"
+					}
+					log.Printf("\t%s %d: send backlog: %d remote now: %d rtt: %v jitter: %v lead: %d clock offset: %.2f tick period: %v", role, p.ID, p.SendBacklog, p.RemoteNow, p.RTT, p.Jitter, p.Lead, p.ClockOffset, p.TickPeriod)
+				}
+			}
+		}()
+	}
 
-func v2(b []byte, v state.V2) []byte {
-	_ = b[:8]
-	binary.LittleEndian.PutUint32(b, uint32(v.X))
-	binary.LittleEndian.PutUint32(b[4:], uint32(v.Y))
-	return b[8:]
+	frontend := make(chan error, 1)
+	go func() { frontend <- readFrontend(n) }()
+	select {
+	case <-ctx.Done():
+		log.Println("shutting down")
+	case err = <-frontend:
+	}
+	// tell the others we are leaving so they don't wait for us to time out, or try to reconnect to a host which is gone.
+	if cerr := n.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("closing netcode: %w", cerr)
+	}
+	return err
 }
 
-func rect(b []byte, r state.Rect) []byte {
-	_ = b[:16]
-	binary.LittleEndian.PutUint32(b, uint32(r.X))
-	binary.LittleEndian.PutUint32(b[4:], uint32(r.Y))
-	binary.LittleEndian.PutUint32(b[8:], uint32(r.W))
-	binary.LittleEndian.PutUint32(b[12:], uint32(r.H))
-	return b[16:]
-}
+// readFrontend handles the commands zig sends us until it closes our stdin.
+func readFrontend(n *netcode.Netcode) error {
+	var cmd rpcgame.Command
+	for {
+		if err := rpcgame.FromFrontend.Read(os.Stdin, &cmd); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil // zig exited
+			}
+			return fmt.Errorf("reading from zig: %w", err)
+		}
 
-func makeBuffer(buf []byte, length uint) []byte {
-	if uint(cap(buf)) < length {
-		return append(buf[:cap(buf)], make([]byte, length-uint(cap(buf)))...)
+		switch cmd.OpCode() {
+		case rpcgame.SetName:
+			name, err := rpcgame.ReadPayload(os.Stdin, &cmd)
+			if err != nil {
+				return fmt.Errorf("reading from zig: %w", err)
+			}
+			if err := n.SetName(string(name)); err != nil {
+				log.Println("ignoring name from zig:", err) // the player can type anything, it must not end the game.
+			}
+		case rpcgame.SetReady:
+			n.SetReady(cmd[2] != 0)
+		case rpcgame.Pause:
+			n.Pause() // go picks the tick
+		case rpcgame.Resume:
+			n.Resume()
+		case rpcgame.Chat:
+			text, err := rpcgame.ReadPayload(os.Stdin, &cmd)
+			if err != nil {
+				return fmt.Errorf("reading from zig: %w", err)
+			}
+			if err := n.Chat(cmd[2], text); err != nil {
+				log.Println("dropping chat from zig:", err) // like names, one bad line must not end the game.
+			}
+		default:
+			n.Act(cmd)
+		}
 	}
-	return buf[:length]
 }
 
-func appendNewBufferAfter(b []byte, length uint) (total, new []byte) {
-	total = append(b, make([]byte, length)...)
-	new = total[len(b):]
-	return
+// readPeerList reads one peer id per line, empty lines and lines starting with # are ignored.
+func readPeerList(path string) ([]peer.ID, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ids []peer.ID
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, err := peer.Decode(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
 }
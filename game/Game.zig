@@ -38,15 +38,35 @@ pub const ReadState = struct {
 
 pub const OpCode = enum(u16) {
     GivePlaneHeading = 0x0001,
+    Pause = 0x0002,
+    Resume = 0x0003,
+    Handoff = 0x0004,
 
     GameInit = 0x0800,
     StateUpdate = 0x0801,
     MapResize = 0x0802,
+
+    SetName = 0x1000,
+    SetReady = 0x1001,
+    Chat = 0x1002,
+
+    Mispredicted = 0x1800,
+    Reconnecting = 0x1801,
+    RosterJoin = 0x1802,
+    RosterLeave = 0x1803,
+    RosterUpdate = 0x1804,
+    GameStart = 0x1805,
+    ChatMessage = 0x1806,
+    Kicked = 0x1807,
+    HostLeaving = 0x1808,
 };
 
 // the following packet sizes exclude the size of the header packet
 pub const PacketSize = enum(usize) {
     GivePlaneHeading = 6,
+    Pause = 4,
+    Resume = 4,
+    Handoff = 8,
 
     GameInit = 42, // NOTE: 42nd byte is size of runways.
     // StateUpdate = dynamic,
@@ -56,12 +76,34 @@ pub const PacketSize = enum(usize) {
         4 + // x
         4 + // y
         2 + // wantHeading
-        2; // heading
+        2 + // heading
+        4; // owner
 
     const runway_size = 1 + // id
         4 + // x
         4 + // y
         2; // heading
+
+    // NOTE: followed by the arguments of the mispredicted command.
+    const mispredicted_size = 4 + // tick
+        2; // opcode
+
+    const reconnecting_size = 4; // attempt
+
+    const roster_join_size = 4; // player
+    const roster_leave_size = 4; // player
+
+    // NOTE: followed by length bytes of name.
+    const roster_update_size = 4 + // player
+        1 + // ready
+        1; // length
+
+    // NOTE: followed by length bytes of text.
+    const chat_message_size = 4 + // player
+        1 + // callout
+        1; // length
+
+    const kicked_size = 1; // banned
 };
 
 pub fn start_server(self: *Game) !void {
@@ -82,6 +124,15 @@ fn handle_inbound(self: *Game) !void {
         switch (r_u16(header[0..2])) {
             @intFromEnum(OpCode.GameInit) => self.read_init_packet() catch break,
             @intFromEnum(OpCode.StateUpdate) => self.read_state_update_packet() catch break,
+            @intFromEnum(OpCode.Mispredicted) => self.read_mispredicted_packet() catch break,
+            @intFromEnum(OpCode.Reconnecting) => self.read_reconnecting_packet() catch break,
+            @intFromEnum(OpCode.RosterJoin) => self.read_roster_join_packet() catch break,
+            @intFromEnum(OpCode.RosterLeave) => self.read_roster_leave_packet() catch break,
+            @intFromEnum(OpCode.RosterUpdate) => self.read_roster_update_packet() catch break,
+            @intFromEnum(OpCode.GameStart) => print("game started\n", .{}),
+            @intFromEnum(OpCode.ChatMessage) => self.read_chat_message_packet() catch break,
+            @intFromEnum(OpCode.Kicked) => self.read_kicked_packet() catch break,
+            @intFromEnum(OpCode.HostLeaving) => print("the host left the game\n", .{}),
             else => |v| print("error: unknown op code from server: {}\n", .{v}),
         }
     }
@@ -172,6 +223,7 @@ fn read_state_update_packet(self: *Game) !void {
             },
             .want_heading = r_u16(b[12..14]),
             .heading = r_u16(b[14..16]),
+            .owner = r_u32(b[16..20]),
         };
     }
 }
@@ -185,6 +237,90 @@ fn read_map_resize_packet(self: *Game) !void {
     self.state.camera_size = r_rect(packet[0..16]);
 }
 
+fn read_mispredicted_packet(self: *Game) !void {
+    const out = self.server_proc.stdout.?;
+
+    var packet = [_]u8{0} ** PacketSize.mispredicted_size;
+    _ = try out.readAll(&packet);
+
+    const tick = r_u32(packet[0..4]);
+    switch (r_u16(packet[4..6])) {
+        @intFromEnum(OpCode.GivePlaneHeading) => {
+            var args = [_]u8{0} ** @intFromEnum(PacketSize.GivePlaneHeading);
+            _ = try out.readAll(&args);
+            print("mispredicted: heading {} for plane {} at tick {}\n", .{ r_u16(args[4..6]), r_u32(args[0..4]), tick });
+        },
+        // go only applies the opcodes of the Mesh namespace unreliably, anything else means we are out of sync with it.
+        else => return error.NotUnreliableOpCode,
+    }
+}
+
+fn read_reconnecting_packet(self: *Game) !void {
+    const out = self.server_proc.stdout.?;
+
+    var packet = [_]u8{0} ** PacketSize.reconnecting_size;
+    _ = try out.readAll(&packet);
+
+    print("lost connection to the server, reconnecting (attempt {})\n", .{r_u32(packet[0..4])});
+}
+
+fn read_roster_join_packet(self: *Game) !void {
+    const out = self.server_proc.stdout.?;
+
+    var packet = [_]u8{0} ** PacketSize.roster_join_size;
+    _ = try out.readAll(&packet);
+
+    print("player {} joined\n", .{r_u32(packet[0..4])});
+}
+
+fn read_roster_leave_packet(self: *Game) !void {
+    const out = self.server_proc.stdout.?;
+
+    var packet = [_]u8{0} ** PacketSize.roster_leave_size;
+    _ = try out.readAll(&packet);
+
+    print("player {} left\n", .{r_u32(packet[0..4])});
+}
+
+fn read_roster_update_packet(self: *Game) !void {
+    const out = self.server_proc.stdout.?;
+
+    var packet = [_]u8{0} ** PacketSize.roster_update_size;
+    _ = try out.readAll(&packet);
+
+    var name = [_]u8{0} ** 255;
+    const len = packet[5];
+    _ = try out.readAll(name[0..len]);
+
+    print("player {} is \"{s}\", ready: {}\n", .{ r_u32(packet[0..4]), name[0..len], packet[4] != 0 });
+}
+
+fn read_chat_message_packet(self: *Game) !void {
+    const out = self.server_proc.stdout.?;
+
+    var packet = [_]u8{0} ** PacketSize.chat_message_size;
+    _ = try out.readAll(&packet);
+
+    var text = [_]u8{0} ** 255;
+    const len = packet[5];
+    _ = try out.readAll(text[0..len]);
+
+    print("player {} says (callout {}): {s}\n", .{ r_u32(packet[0..4]), packet[4], text[0..len] });
+}
+
+fn read_kicked_packet(self: *Game) !void {
+    const out = self.server_proc.stdout.?;
+
+    var packet = [_]u8{0} ** PacketSize.kicked_size;
+    _ = try out.readAll(&packet);
+
+    if (packet[0] != 0) {
+        print("banned by the host\n", .{});
+    } else {
+        print("kicked by the host\n", .{});
+    }
+}
+
 //
 // write packet
 //
@@ -222,6 +358,8 @@ pub const Plane = struct {
     pos: V2 = .{ .x = 0, .y = 0 },
     want_heading: u16 = 0,
     heading: u16 = 0,
+    // player controlling it when the server splits the planes between players.
+    owner: u32 = 0,
 
     pub const size: V2 = .{ .x = 64, .y = 64 };
 
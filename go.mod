@@ -5,6 +5,7 @@ go 1.23.5
 require (
 	github.com/libp2p/go-libp2p v0.35.4
 	github.com/multiformats/go-multiaddr v0.12.4
+	golang.org/x/net v0.25.0
 )
 
 require (
@@ -98,7 +99,6 @@ require (
 	golang.org/x/crypto v0.23.0 // indirect
 	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
 	golang.org/x/mod v0.17.0 // indirect
-	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
 	golang.org/x/sys v0.20.0 // indirect
 	golang.org/x/text v0.15.0 // indirect
@@ -0,0 +1,117 @@
+// Package manualclock is a fake clock for tests, it only moves when the test advances it.
+package manualclock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock implements the clocks of netcode and netsim, timers fire once [Clock.Advance] moves past them.
+type Clock struct {
+	lk       sync.Mutex
+	cond     sync.Cond
+	now      time.Time
+	timers   []*timer
+	sleepers int
+}
+
+type timer struct {
+	at      time.Time
+	f       func()
+	stopped bool
+	sleeper bool // a goroutine is blocked in [Clock.Sleep] until it fires
+}
+
+func New() *Clock {
+	c := &Clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c.cond.L = &c.lk
+	return c
+}
+
+func (c *Clock) Now() time.Time {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.now
+}
+
+func (c *Clock) AfterFunc(d time.Duration, f func()) func() bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	t := c.addTimer(d, f)
+	return func() bool {
+		c.lk.Lock()
+		defer c.lk.Unlock()
+		wasPending := !t.stopped
+		t.stopped = true
+		return wasPending
+	}
+}
+
+// addTimer must be called holding c.lk.
+func (c *Clock) addTimer(d time.Duration, f func()) *timer {
+	t := &timer{at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return t
+}
+
+func (c *Clock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	done := make(chan struct{})
+	c.lk.Lock()
+	c.addTimer(d, func() { close(done) }).sleeper = true
+	c.sleepers++
+	c.cond.Broadcast()
+	c.lk.Unlock()
+	<-done
+}
+
+// BlockUntil waits until at least n goroutines are sleeping on the clock.
+func (c *Clock) BlockUntil(n int) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	for c.sleepers < n {
+		c.cond.Wait()
+	}
+}
+
+// BlockUntilTimers waits until at least n timers, sleepers included, are pending on the clock.
+func (c *Clock) BlockUntilTimers(n int) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	for {
+		var pending int
+		for _, t := range c.timers {
+			if !t.stopped {
+				pending++
+			}
+		}
+		if pending >= n {
+			return
+		}
+		c.cond.Wait()
+	}
+}
+
+// Advance moves time forward by d and fires the timers which are due, in order.
+// Woken sleepers stop counting right away, so a [Clock.BlockUntil] following it waits for them to go back to sleep.
+func (c *Clock) Advance(d time.Duration) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.now = c.now.Add(d)
+	sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+	var i int
+	for ; i < len(c.timers) && !c.timers[i].at.After(c.now); i++ {
+		if t := c.timers[i]; !t.stopped {
+			t.stopped = true
+			if t.sleeper {
+				c.sleepers--
+			}
+			go t.f()
+		}
+	}
+	c.timers = c.timers[i:]
+}
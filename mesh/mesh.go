@@ -0,0 +1,195 @@
+// Package mesh is the optional unreliable shortcut between players described in NET.md.
+//
+// Commands are sent as single UDP datagrams directly to the other players, they skip the server and any Head-Of-Line blocking.
+// They are only optimistic, the same commands always go through the reliable pipeline too.
+// Datagrams are only accepted from the address the server gave us for the player they claim to be from.
+// UDP source addresses can still be forged on some networks, at worst that makes receivers mispredict until the server relays the real command.
+// The mesh can be partial, players missing from it just get the commands through the reliable pipeline a bit later.
+package mesh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	mrand "math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+	"github.com/Jorropo/OpenAirways/state"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// dscpEF is Expedited Forwarding, shifted in the TOS / Traffic Class byte.
+const dscpEF = 46 << 2
+
+// headerSize is the when u32 + the player u32 in front of every datagram.
+const headerSize = 8
+
+// maxDatagramSize is the biggest datagram we ever send: header + the biggest command.
+const maxDatagramSize = headerSize + len(rpcgame.Command{})
+
+// Listen opens an UDP socket for the mesh.
+// It tries to mark packets with DSCP EF, it is best effort since not all OSes let us.
+func Listen(addr string) (net.PacketConn, error) {
+	c, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	_ = ipv4.NewPacketConn(c).SetTOS(dscpEF)
+	_ = ipv6.NewPacketConn(c).SetTrafficClass(dscpEF)
+	return c, nil
+}
+
+// Lossy wraps c and drops outgoing datagrams with probability loss, it is used to test how the game behaves with a bad network.
+func Lossy(c net.PacketConn, loss float64) net.PacketConn {
+	return &lossy{PacketConn: c, loss: loss}
+}
+
+type lossy struct {
+	net.PacketConn
+	loss float64
+}
+
+func (l *lossy) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if mrand.Float64() < l.loss {
+		return len(b), nil // pretend it was sent
+	}
+	return l.PacketConn.WriteTo(b, addr)
+}
+
+// Mesh sends commands to a set of peers and delivers the ones it receives.
+type Mesh struct {
+	c       net.PacketConn
+	deliver func(when state.Time, player uint32, cmd rpcgame.Command)
+
+	lk    sync.Mutex
+	peers map[uint32]netip.AddrPort
+
+	sent, received, invalid, spoofed atomic.Uint64
+}
+
+// New starts a mesh on c, deliver is called from the receive loop for every valid command received.
+func New(c net.PacketConn, deliver func(when state.Time, player uint32, cmd rpcgame.Command)) *Mesh {
+	m := &Mesh{c: c, deliver: deliver}
+	go m.recvLoop()
+	return m
+}
+
+// LocalAddr returns the address we listen on, the IP might be unspecified.
+func (m *Mesh) LocalAddr() netip.AddrPort {
+	if a, ok := m.c.LocalAddr().(*net.UDPAddr); ok {
+		return a.AddrPort()
+	}
+	return netip.AddrPort{}
+}
+
+// SetPeers replaces the players we send commands to and accept commands from, keyed by player id.
+func (m *Mesh) SetPeers(peers map[uint32]netip.AddrPort) {
+	unmapped := make(map[uint32]netip.AddrPort, len(peers))
+	for id, a := range peers {
+		unmapped[id] = unmap(a)
+	}
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.peers = unmapped
+}
+
+// unmap makes IPv4 addresses comparable whether they came from an IPv4 or dual stack socket.
+func unmap(a netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(a.Addr().Unmap(), a.Port())
+}
+
+// Send sends cmd from player happening at when to all peers.
+// Errors are ignored since the command also goes through the reliable pipeline.
+func (m *Mesh) Send(when state.Time, player uint32, cmd rpcgame.Command) {
+	m.lk.Lock()
+	peers := m.peers
+	m.lk.Unlock()
+	if len(peers) == 0 {
+		return
+	}
+
+	b := binary.LittleEndian.AppendUint32(make([]byte, 0, maxDatagramSize), uint32(when))
+	b = binary.LittleEndian.AppendUint32(b, player)
+	b = append(b, cmd.Bytes()...)
+	for _, p := range peers {
+		if _, err := m.c.WriteTo(b, net.UDPAddrFromAddrPort(p)); err != nil {
+			continue
+		}
+		m.sent.Add(1)
+	}
+}
+
+// Close stops the receive loop and closes the underlying socket.
+func (m *Mesh) Close() error {
+	return m.c.Close()
+}
+
+func (m *Mesh) recvLoop() {
+	var buf [maxDatagramSize + 1]byte // one more to detect oversized datagrams
+	var cmd rpcgame.Command
+	for {
+		n, from, err := m.c.ReadFrom(buf[:])
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("mesh receive error:", err)
+			}
+			return
+		}
+		if n < headerSize || n > maxDatagramSize {
+			m.invalid.Add(1)
+			continue
+		}
+		when := state.Time(binary.LittleEndian.Uint32(buf[:]))
+		player := binary.LittleEndian.Uint32(buf[4:])
+		r := bytes.NewReader(buf[headerSize:n])
+		if err := rpcgame.Mesh.Read(r, &cmd); err != nil || r.Len() != 0 {
+			m.invalid.Add(1)
+			continue
+		}
+		if !m.from(player, from) {
+			m.spoofed.Add(1)
+			continue
+		}
+		m.received.Add(1)
+		m.deliver(when, player, cmd)
+	}
+}
+
+// from returns true if addr is the one we know player by.
+func (m *Mesh) from(player uint32, addr net.Addr) bool {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	want, ok := m.peers[player]
+	return ok && want == unmap(a.AddrPort())
+}
+
+type Stats struct {
+	Peers    int    // how many peers we currently send to, it is not a counter
+	Sent     uint64 // datagrams sent, counted once per peer
+	Received uint64 // valid commands received
+	Invalid  uint64 // datagrams received which could not be decoded
+	Spoofed  uint64 // datagrams received from another address than the one of the player they claim to be from
+}
+
+func (m *Mesh) Stats() Stats {
+	m.lk.Lock()
+	peers := len(m.peers)
+	m.lk.Unlock()
+	return Stats{
+		Peers:    peers,
+		Sent:     m.sent.Load(),
+		Received: m.received.Load(),
+		Invalid:  m.invalid.Load(),
+		Spoofed:  m.spoofed.Load(),
+	}
+}
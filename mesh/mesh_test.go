@@ -0,0 +1,134 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+	"github.com/Jorropo/OpenAirways/state"
+)
+
+func listen(t *testing.T) net.PacketConn {
+	t.Helper()
+	c, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestLossy(t *testing.T) {
+	const sent = 1000
+	const loss = .5
+
+	received := make(chan rpcgame.Command, sent)
+	b := New(listen(t), func(_ state.Time, _ uint32, cmd rpcgame.Command) { received <- cmd })
+	defer b.Close()
+	a := New(Lossy(listen(t), loss), func(state.Time, uint32, rpcgame.Command) { t.Error("a should not receive anything") })
+	defer a.Close()
+	a.SetPeers(map[uint32]netip.AddrPort{2: b.LocalAddr()})
+	b.SetPeers(map[uint32]netip.AddrPort{1: a.LocalAddr()})
+
+	for i := range sent {
+		a.Send(state.Time(i), 1, rpcgame.EncodeGivePlaneHeading(uint32(i), 0))
+		if i%64 == 0 {
+			time.Sleep(time.Millisecond) // don't overflow the socket buffers, we only want to measure the injected loss
+		}
+	}
+
+	var got int
+loop:
+	for {
+		select {
+		case <-received:
+			got++
+		case <-time.After(200 * time.Millisecond):
+			break loop
+		}
+	}
+	if got < sent*loss*.8 || got > sent*loss*1.2 {
+		t.Fatalf("received %d out of %d with %v loss", got, sent, loss)
+	}
+}
+
+func TestInvalidDatagrams(t *testing.T) {
+	type delivered struct {
+		player uint32
+		cmd    rpcgame.Command
+	}
+	received := make(chan delivered, 1)
+	m := New(listen(t), func(_ state.Time, player uint32, cmd rpcgame.Command) { received <- delivered{player, cmd} })
+	defer m.Close()
+
+	c := listen(t)
+	defer c.Close()
+	m.SetPeers(map[uint32]netip.AddrPort{3: c.LocalAddr().(*net.UDPAddr).AddrPort()})
+	to := net.UDPAddrFromAddrPort(m.LocalAddr())
+	valid := rpcgame.EncodeGivePlaneHeading(42, 1234)
+	for _, d := range [][]byte{
+		{1, 0, 0, 0, 3, 0}, // too short
+		binary.LittleEndian.AppendUint16(make([]byte, headerSize), uint16(rpcgame.CommitTick)), // not allowed on the mesh
+		append(make([]byte, headerSize), valid.Bytes()[:5]...),                                 // truncated
+		append(append(make([]byte, headerSize), valid.Bytes()...), 0),                          // trailing garbage
+		append([]byte{1, 0, 0, 0, 3, 0, 0, 0}, valid.Bytes()...),
+	} {
+		if _, err := c.WriteTo(d, to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case d := <-received:
+		if d.cmd != valid || d.player != 3 {
+			t.Fatalf("expected %v from player 3; got %v from player %d", valid, d.cmd, d.player)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("valid datagram not received")
+	}
+	if s := m.Stats(); s.Invalid != 4 || s.Received != 1 {
+		t.Fatalf("expected 4 invalid and 1 received; got %+v", s)
+	}
+}
+
+func TestSpoofedDatagrams(t *testing.T) {
+	received := make(chan uint32, 3)
+	m := New(listen(t), func(_ state.Time, player uint32, _ rpcgame.Command) { received <- player })
+	defer m.Close()
+
+	real, spoofer := listen(t), listen(t)
+	defer real.Close()
+	defer spoofer.Close()
+	m.SetPeers(map[uint32]netip.AddrPort{3: real.LocalAddr().(*net.UDPAddr).AddrPort()})
+	to := net.UDPAddrFromAddrPort(m.LocalAddr())
+	cmd := rpcgame.EncodeGivePlaneHeading(42, 1234)
+	from := func(player uint32) []byte {
+		return append(binary.LittleEndian.AppendUint32([]byte{1, 0, 0, 0}, player), cmd.Bytes()...)
+	}
+	for _, d := range []struct {
+		c net.PacketConn
+		b []byte
+	}{
+		{spoofer, from(3)}, // someone else claiming to be player 3
+		{real, from(4)},    // player 3 claiming to be someone else
+		{real, from(3)},
+	} {
+		if _, err := d.c.WriteTo(d.b, to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case player := <-received:
+		if player != 3 {
+			t.Fatalf("expected the command from player 3; got one from %d", player)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("datagram from the real player not received")
+	}
+	if s := m.Stats(); s.Spoofed != 2 || s.Received != 1 {
+		t.Fatalf("expected 2 spoofed and 1 received; got %+v", s)
+	}
+}
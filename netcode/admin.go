@@ -0,0 +1,112 @@
+package netcode
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var (
+	errKicked = errors.New("kicked by the host")
+	errBanned = errors.New("banned by the host")
+	errResync = errors.New("resync requested by the host")
+)
+
+// farewellGrace is how long the write loop has to tell a peer why it is disconnected, like when it is kicked, before it's stream is reset anyway.
+const farewellGrace = time.Second
+
+// sayFarewell writes b, if any, and waits for p to hang up, resetting the stream would discard it.
+// The reset from [Netcode.disconnect] after [farewellGrace] bounds the wait.
+func sayFarewell(s network.Stream, p *player, b []byte) {
+	if b == nil {
+		return
+	}
+	if _, err := s.Write(b); err == nil {
+		s.CloseWrite()
+		<-p.recvDone
+	}
+}
+
+// Kick disconnects player id and tells it to not reconnect, it can still join again by restarting.
+// It goes through the same cleanup as any other disconnection.
+func (n *Netcode) Kick(id uint32) error {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	p, err := n.adminPlayer(id)
+	if err != nil {
+		return err
+	}
+	n.kick(p, false)
+	return nil
+}
+
+// Ban kicks the player connected from peer id, if any, and refuses it's connections for the rest of the session.
+func (n *Netcode) Ban(id peer.ID) error {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if n.target != "" {
+		return fmt.Errorf("only the server can ban players")
+	}
+	n.banned[id] = true
+	n.dropMeshPeer(id)
+	if pid, ok := n.identities[id]; ok {
+		if p, ok := n.players[pid]; ok {
+			n.kick(p, true)
+		}
+	}
+	return nil
+}
+
+// Resync disconnects player id without telling it to stay away, it reconnects right away and gets our commited state and the catch-up again like when it joined.
+// It is meant for players which desynced.
+func (n *Netcode) Resync(id uint32) error {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	p, err := n.adminPlayer(id)
+	if err != nil {
+		return err
+	}
+	n.disconnect(p, errResync)
+	return nil
+}
+
+// adminPlayer returns the connected player with this id.
+// Must be called holding [n.lk].
+func (n *Netcode) adminPlayer(id uint32) (*player, error) {
+	if n.target != "" {
+		return nil, fmt.Errorf("only the server can manage players")
+	}
+	p, ok := n.players[id]
+	if !ok || p.err != nil {
+		return nil, fmt.Errorf("player %d is not connected", id)
+	}
+	return p, nil
+}
+
+// kick disconnects p after telling it to not reconnect.
+// Must be called holding [n.lk].
+func (n *Netcode) kick(p *player, banned bool) {
+	if p.err != nil {
+		return
+	}
+	c := rpcgame.EncodeKicked(banned)
+	p.farewell = &c
+	n.dropMeshPeer(p.s.Conn().RemotePeer()) // so it stops getting mesh traffic from the others.
+	err := errKicked
+	if banned {
+		err = errBanned
+	}
+	n.disconnect(p, err)
+}
+
+// gotKicked stops the client from reconnecting and tells the frontend, c is Kicked or HostLeaving.
+// Must be called holding [n.lk].
+func (n *Netcode) gotKicked(c rpcgame.Command) {
+	n.kicked = true
+	n.disconnected = &c
+	n.stateCond.Broadcast()
+}
@@ -0,0 +1,120 @@
+package netcode
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Password sets the room password, on the server clients must give the same one to join and on clients it is the one we give.
+// It is sent in clear over the libp2p secure channel, it can be at most 255 bytes long.
+func Password(password string) Option {
+	return func(n *Netcode) {
+		n.password = password
+	}
+}
+
+// AllowPeers only lets these peers join, the libp2p peer id is authenticated by the secure channel.
+// It can be given multiple times, without it everyone knowing the password can join.
+func AllowPeers(ids ...peer.ID) Option {
+	return func(n *Netcode) {
+		if n.allowed == nil {
+			n.allowed = make(map[peer.ID]bool)
+		}
+		for _, id := range ids {
+			n.allowed[id] = true
+		}
+	}
+}
+
+// RejectedError is returned when the server refused to let us join, retrying won't help.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "rejected by the server: " + e.Reason
+}
+
+// appendHello appends what the client sends before anything else on a game stream negotiated to proto: our version, role and the room password.
+func (n *Netcode) appendHello(b []byte, proto protocol.ID, role byte) []byte {
+	b = n.versionOn(proto).append(b)
+	b = append(b, role, uint8(len(n.password)))
+	return append(b, n.password...)
+}
+
+// readHello reads what the client sent with [Netcode.appendHello] on the connection s.
+// The role and password are not read if their version is incompatible since they might not be laid out the same way.
+func (n *Netcode) readHello(s network.Stream) (theirs version, role byte, password []byte, err error) {
+	if n.readTimeout != 0 {
+		// they aren't tracked by the read loop timeouts yet, not all transports support deadlines so do it by hand.
+		stop := n.clock.AfterFunc(n.readTimeout, func() { s.Reset() })
+		defer stop()
+	}
+	theirs, err = readVersion(s)
+	if err != nil || n.versionOn(s.Protocol()).compatible(theirs) != nil {
+		return theirs, 0, nil, err
+	}
+	var b [2]byte // role + len(password)
+	if _, err := io.ReadFull(s, b[:]); err != nil {
+		return theirs, 0, nil, fmt.Errorf("reading role: %w", err)
+	}
+	if b[0] > roleSpectator {
+		return theirs, 0, nil, fmt.Errorf("unknown role: %d", b[0])
+	}
+	password = make([]byte, b[1])
+	if _, err := io.ReadFull(s, password); err != nil {
+		return theirs, 0, nil, fmt.Errorf("reading password: %w", err)
+	}
+	return theirs, b[0], password, nil
+}
+
+// admit returns why remote can't join, or an empty string if it can.
+// Must be called holding [n.lk].
+func (n *Netcode) admit(remote peer.ID, password []byte) string {
+	if n.banned[remote] {
+		return errBanned.Error()
+	}
+	if n.allowed != nil && !n.allowed[remote] {
+		return "not allowed to join this room"
+	}
+	if subtle.ConstantTimeCompare(password, []byte(n.password)) != 1 {
+		return "wrong password"
+	}
+	return ""
+}
+
+// reject tells the client why it can't join before hanging up, reason must be at most 255 bytes long.
+func (n *Netcode) reject(s network.Stream, reason string) error {
+	b := n.versionOn(s.Protocol()).append(nil)
+	b = append(b, uint8(len(reason)))
+	b = append(b, reason...)
+	if _, err := s.Write(b); err == nil {
+		// resetting would discard it, wait for the client to hang up.
+		s.CloseWrite()
+		stop := n.clock.AfterFunc(farewellGrace, func() { s.Reset() })
+		io.Copy(io.Discard, s)
+		stop()
+	}
+	return fmt.Errorf("rejected: %s", reason)
+}
+
+// readAdmission reads if the server let us join, it returns a [*RejectedError] with the reason if it didn't.
+func readAdmission(s network.Stream) error {
+	var l [1]byte
+	if _, err := io.ReadFull(s, l[:]); err != nil {
+		return fmt.Errorf("reading admission: %w", err)
+	}
+	if l[0] == 0 {
+		return nil
+	}
+	reason := make([]byte, l[0])
+	if _, err := io.ReadFull(s, reason); err != nil {
+		return fmt.Errorf("reading rejection reason: %w", err)
+	}
+	return &RejectedError{Reason: string(reason)}
+}
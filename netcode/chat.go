@@ -0,0 +1,122 @@
+package netcode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"time"
+
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+)
+
+// chatMessage is a chat message relayed by the server.
+type chatMessage struct {
+	player  uint32
+	callout uint8
+	text    []byte
+}
+
+// ChatRateLimit sets how many chat messages per second a player can send on average, and how many it can send in a row.
+// Messages over the limit are dropped by the server. Zero perSecond disables the limit.
+func ChatRateLimit(perSecond float64, burst uint) Option {
+	return func(n *Netcode) {
+		n.chatRate = perSecond
+		n.chatBurst = float64(burst)
+	}
+}
+
+// ChatHistory sets how many of the latest chat messages the server sends to players joining.
+func ChatHistory(messages int) Option {
+	return func(n *Netcode) {
+		n.maxChatHistory = messages
+	}
+}
+
+// Chat sends a chat message to everyone, see [rpcgame.EncodeChat].
+// The server relays it back to us like to every other player, the frontend gets it then.
+// Spectators can't chat, their messages are dropped without error since the frontend doesn't know our role.
+func (n *Netcode) Chat(callout uint8, text []byte) error {
+	if err := rpcgame.ValidChat(callout, text); err != nil {
+		return err
+	}
+	text = slices.Clone(text)
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if n.target == "" {
+		n.relayChat(chatMessage{0, callout, text})
+		return nil
+	}
+	if n.spectator {
+		return nil
+	}
+	if n.pushSentPayload(0, n.rollback.Live.Now, rpcgame.EncodeChat(callout, text), text) {
+		n.sendCond.Broadcast()
+	}
+	return nil
+}
+
+// relayChat gives m to the frontend, adds it to the history and relays it to every client.
+// Must be called holding [n.lk].
+func (n *Netcode) relayChat(m chatMessage) {
+	n.chatHistory = append(n.chatHistory, m)
+	if extra := len(n.chatHistory) - max(n.maxChatHistory, 0); extra > 0 {
+		n.chatHistory = slices.Delete(n.chatHistory, 0, extra)
+	}
+	n.gotChatMessage(rpcgame.EncodeChatMessage(m.player, m.callout, m.text), m.text)
+	if n.pushSentPayload(0, n.rollback.Commit.Now, rpcgame.EncodeChatMessage(m.player, m.callout, m.text), m.text) {
+		n.sendCond.Broadcast()
+	}
+}
+
+// gotChat handles a chat message from p on the server.
+// Must be called holding [n.lk].
+func (n *Netcode) gotChat(p *player, c rpcgame.Command, text []byte, now time.Time) error {
+	callout := c[2]
+	if err := rpcgame.ValidChat(callout, text); err != nil {
+		return fmt.Errorf("invalid chat message: %w", err)
+	}
+	if !p.takeChatToken(now, n.chatRate, n.chatBurst) {
+		n.chatDropped++
+		return nil
+	}
+	n.relayChat(chatMessage{p.id, callout, text})
+	return nil
+}
+
+// gotChatMessage gives a relayed chat message to the frontend.
+// Must be called holding [n.lk].
+func (n *Netcode) gotChatMessage(c rpcgame.Command, text []byte) {
+	n.chatEvents = append(n.chatEvents, chatMessage{binary.LittleEndian.Uint32(c[2:]), c[6], text})
+	n.stateCond.Broadcast()
+}
+
+// appendChatHistory appends the chat history to a server to client catch-up.
+// Must be called holding [n.lk].
+func (n *Netcode) appendChatHistory(b []byte) []byte {
+	for _, m := range n.chatHistory {
+		c := rpcgame.EncodeChatMessage(m.player, m.callout, m.text)
+		b = binary.LittleEndian.AppendUint32(b, uint32(n.rollback.Commit.Now))
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		b = append(b, c.Bytes()...)
+		b = append(b, m.text...)
+	}
+	return b
+}
+
+// takeChatToken returns true if p is allowed to send a chat message now, it is a token bucket which starts full.
+func (p *player) takeChatToken(now time.Time, rate, burst float64) bool {
+	if rate == 0 {
+		return true
+	}
+	if p.chatRefilledAt.IsZero() {
+		p.chatTokens = burst
+	} else {
+		p.chatTokens = min(burst, p.chatTokens+now.Sub(p.chatRefilledAt).Seconds()*rate)
+	}
+	p.chatRefilledAt = now
+	if p.chatTokens < 1 {
+		return false
+	}
+	p.chatTokens--
+	return true
+}
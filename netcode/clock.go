@@ -0,0 +1,21 @@
+package netcode
+
+import "time"
+
+// Clock is where the netcode gets the time from, [UseClock] replaces it so tests can step time manually.
+type Clock interface {
+	Now() time.Time
+	// Sleep blocks until d has passed.
+	Sleep(d time.Duration)
+	// AfterFunc calls f in it's own goroutine once d has passed, unless stop is called first.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// realClock is the default [Clock], backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
@@ -0,0 +1,475 @@
+package netcode
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jorropo/OpenAirways/internal/manualclock"
+	"github.com/Jorropo/OpenAirways/replay"
+	"github.com/Jorropo/OpenAirways/rollback"
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+	"github.com/Jorropo/OpenAirways/state"
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+// manualGame is a server and clients in-process, all on the same manual clock.
+type manualGame struct {
+	clock   *manualclock.Clock
+	server  *Netcode
+	clients []*Netcode
+	spares  []host.Host // on the same network but not running the netcode, for misbehaving clients
+}
+
+func newManualGame(t *testing.T, clients, spares int, opts ...Option) *manualGame {
+	t.Helper()
+	hosts := newMocknet(t, 1+clients+spares)
+	g := &manualGame{clock: manualclock.New()}
+	opts = append(opts, UseClock(g.clock))
+	var err error
+	g.server, err = New(context.Background(), hosts[0], nopFrontend{}, "", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.spares = hosts[1+clients:]
+	for _, h := range hosts[1 : 1+clients] {
+		c, err := New(context.Background(), h, nopFrontend{}, hosts[0].ID(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.clients = append(g.clients, c)
+	}
+	return g
+}
+
+// step advances time tick by tick, waiting for every tick loop to be asleep before each step.
+func (g *manualGame) step(ticks int) {
+	for range ticks {
+		g.clock.BlockUntil(1 + len(g.clients))
+		g.clock.Advance(waitPerTick)
+	}
+}
+
+func commitOf(n *Netcode) (state.Time, []byte) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	return n.rollback.Commit.Now, n.rollback.Commit.AppendMarshalBinary(nil)
+}
+
+func (g *manualGame) converged() bool {
+	now, want := commitOf(g.server)
+	for _, c := range g.clients {
+		cnow, got := commitOf(c)
+		if cnow != now || !bytes.Equal(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestManualClockConverges(t *testing.T) {
+	g := newManualGame(t, 3, 0)
+
+	g.step(state.TickRate)
+	waitFor(t, "commits to follow the clock", func() bool {
+		now, _ := commitOf(g.server)
+		return now >= state.TickRate/2
+	})
+	before, _ := commitOf(g.server)
+
+	const heading = 4321
+	g.clients[1].Act(rpcgame.EncodeGivePlaneHeading(0, heading))
+	g.step(state.TickRate)
+	waitFor(t, "the command to be commited", func() bool {
+		g.server.lk.Lock()
+		defer g.server.lk.Unlock()
+		planes := g.server.rollback.Commit.Planes
+		return len(planes) != 0 && planes[0].WantHeading == heading
+	})
+	waitFor(t, "everyone to commit the same state", g.converged)
+	if after, _ := commitOf(g.server); after <= before {
+		t.Fatalf("commit did not progress: %d -> %d", before, after)
+	}
+}
+
+func TestManualClockDisconnectCleanup(t *testing.T) {
+	g := newManualGame(t, 2, 1, MaxCommitLag(state.TickRate*60))
+	waitFor(t, "the clients to join", func() bool { return len(g.server.Stats().Remotes) == 2 })
+
+	// a client which joins and never sends anything blocks commits until it times out.
+	rawClient(t, g.spares[0], g.server.h)
+	waitFor(t, "the silent client to join", func() bool { return len(g.server.Stats().Remotes) == 3 })
+	stuck, _ := commitOf(g.server)
+
+	g.step(int(DefaultReadTimeout/waitPerTick) / 2)
+	if now, _ := commitOf(g.server); now > stuck+1 {
+		t.Fatalf("expected the silent client to block commits; went from %d to %d", stuck, now)
+	}
+
+	g.step(int(DefaultReadTimeout/waitPerTick)/2 + state.TickRate)
+	waitFor(t, "the silent client to be cleaned up", func() bool { return len(g.server.Stats().Remotes) == 2 })
+	g.step(state.TickRate)
+	waitFor(t, "commits to resume", func() bool {
+		now, _ := commitOf(g.server)
+		return now > stuck+state.TickRate/2
+	})
+	waitFor(t, "everyone to commit the same state", g.converged)
+}
+
+func TestManualClockSpectator(t *testing.T) {
+	g := newManualGame(t, 1, 2)
+	spectator, err := New(context.Background(), g.spares[0], nopFrontend{}, g.server.h.ID(), Spectate(), UseClock(g.clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.clients = append(g.clients, spectator)
+	waitFor(t, "everyone to join", func() bool { return len(g.server.Stats().Remotes) == 2 })
+
+	// a spectator which never sends anything does not block commits.
+	raw := rawClientAs(t, g.spares[1], g.server.h, roleSpectator)
+	waitFor(t, "the silent spectator to join", func() bool { return len(g.server.Stats().Remotes) == 3 })
+	if r := g.server.Roster(); len(r) != 2 {
+		t.Fatalf("expected spectators to not be in the roster; got %v", r)
+	}
+	before, _ := commitOf(g.server)
+	g.step(state.TickRate)
+	waitFor(t, "commits to keep going", func() bool {
+		now, _ := commitOf(g.server)
+		return now > before+state.TickRate/2
+	})
+
+	spectator.Act(rpcgame.EncodeGivePlaneHeading(0, 1234)) // ignored
+	if err := spectator.Chat(0, []byte("hi")); err != nil {
+		t.Fatalf("expected chat from spectators to be dropped quietly; got %v", err)
+	}
+	if q := spectator.Stats().SendQueue; q != 0 {
+		t.Fatalf("expected the spectator to not send anything; got %d queued", q)
+	}
+	g.clients[0].Act(rpcgame.EncodeGivePlaneHeading(0, 4321))
+	g.step(state.TickRate)
+	waitFor(t, "the spectator to see the command commited", func() bool {
+		spectator.lk.Lock()
+		defer spectator.lk.Unlock()
+		p := spectator.rollback.Commit.Planes[0]
+		return p.WantHeading == 4321 && p.CommandedBy == g.clients[0].id
+	})
+	waitFor(t, "the spectator to follow the game", g.converged)
+
+	// spectators don't send commands, they don't get to join the mesh.
+	ms, err := g.spares[1].NewStream(context.Background(), g.server.h.ID(), MeshProto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Reset()
+	if _, err := ms.Write(appendAddrPort(nil, netip.MustParseAddrPort("127.0.0.1:4242"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the spectator's mesh signaling to be refused")
+	}
+	g.server.lk.Lock()
+	meshPeers := len(g.server.meshPeers)
+	g.server.lk.Unlock()
+	if meshPeers != 0 {
+		t.Fatalf("expected the spectator to not be in the mesh; got %d mesh peers", meshPeers)
+	}
+
+	// game opcodes from spectators are rejected.
+	c := rpcgame.EncodeGivePlaneHeading(0, 1234)
+	if _, err := raw.Write(c.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the spectator to be kicked", func() bool { return len(g.server.Stats().Remotes) == 2 })
+}
+
+func TestManualClockOwnership(t *testing.T) {
+	var recorded syncBuffer
+	g := newManualGame(t, 0, 2, Ownership(), Record(&recorded, replay.Metadata{}))
+	for _, h := range g.spares {
+		c, err := New(context.Background(), h, nopFrontend{}, g.server.h.ID(), UseClock(g.clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.clients = append(g.clients, c)
+	}
+	a, b := g.clients[0], g.clients[1]
+	waitFor(t, "the clients to join", func() bool { return len(g.server.Stats().Remotes) == 2 })
+
+	plane := func() state.Plane {
+		g.server.lk.Lock()
+		defer g.server.lk.Unlock()
+		if len(g.server.rollback.Commit.Planes) == 0 {
+			return state.Plane{}
+		}
+		return g.server.rollback.Commit.Planes[0]
+	}
+	// ignored waits for the tick c just gave the command on to be commited and checks the server dropped it instead of relaying it.
+	ignored := func(c *Netcode, cmd rpcgame.Command) {
+		t.Helper()
+		c.lk.Lock()
+		at := c.rollback.Live.Now
+		c.lk.Unlock()
+		c.Act(cmd)
+		g.step(state.TickRate)
+		waitFor(t, "the command's tick to be commited", func() bool {
+			now, _ := commitOf(g.server)
+			return now > at
+		})
+		g.step(state.TickRate * 2) // the record loop flushes every second
+		var relayed bool
+		waitFor(t, "the command's tick to be recorded", func() bool {
+			var ok bool
+			relayed, ok = recordedFrom(t, recorded.Bytes(), c.id, at)
+			return ok
+		})
+		if relayed {
+			t.Fatalf("expected %v from player %d to be dropped by the server; it was relayed", cmd.OpCode(), c.id)
+		}
+		if p := plane(); p.WantHeading != 0 || p.Owner != a.id {
+			t.Fatalf("expected %v from player %d to be ignored; got heading %d owned by %d", cmd.OpCode(), c.id, p.WantHeading, p.Owner)
+		}
+	}
+
+	g.step(state.TickRate)
+	waitFor(t, "everyone to control planes", func() bool {
+		g.server.lk.Lock()
+		defer g.server.lk.Unlock()
+		return len(g.server.rollback.Commit.Controllers) == 3 && len(g.server.rollback.Commit.Planes) != 0
+	})
+	if p := plane(); p.Owner != 0 {
+		t.Fatalf("expected the first plane to spawn before the clients joined; owned by %d", p.Owner)
+	}
+
+	g.server.Handoff(0, a.id)
+	g.step(state.TickRate)
+	waitFor(t, "the plane to be handed off", func() bool { return plane().Owner == a.id })
+
+	ignored(b, rpcgame.EncodeGivePlaneHeading(0, 1234))
+	ignored(b, rpcgame.EncodeHandoff(0, b.id))
+
+	a.Act(rpcgame.EncodeGivePlaneHeading(0, 4321))
+	g.step(state.TickRate)
+	waitFor(t, "the owner's command to be commited", func() bool {
+		p := plane()
+		return p.WantHeading == 4321 && p.CommandedBy == a.id
+	})
+	waitFor(t, "everyone to commit the same state", g.converged)
+}
+
+func TestManualClockPauseIsClamped(t *testing.T) {
+	// the raw client never sends CommitTick nor heartbeats, don't let it be disconnected for it.
+	g := newManualGame(t, 0, 1, ReadTimeout(time.Hour), MaxCommitLag(state.TickRate*60))
+	raw := rawClient(t, g.spares[0], g.server.h)
+	go io.Copy(io.Discard, raw)
+
+	live := func() state.State {
+		g.server.lk.Lock()
+		defer g.server.lk.Unlock()
+		return g.server.rollback.Live
+	}
+	sentAt := live().Now + 1 // where the server lets a new player start sending
+	pause := rpcgame.EncodePause(math.MaxUint32)
+	if _, err := raw.Write(pause.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	g.step(1)
+	waitFor(t, "the pause to be applied", func() bool { return live().Pausing })
+	if at := live().PauseAt; at > sentAt+maxPauseLead {
+		t.Fatalf("expected the pause to be clamped to %d ticks after %d; scheduled at %d", maxPauseLead, sentAt, at)
+	}
+	g.step(maxPauseLead + 1)
+	waitFor(t, "the game to pause", g.server.Paused)
+
+	resume := rpcgame.EncodeResume(math.MaxUint32)
+	if _, err := raw.Write(resume.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the resume to be applied", func() bool { return !g.server.Paused() })
+	frozenAt := live().Now
+	g.step(MaxResumeDelay + 2)
+	waitFor(t, "the game to restart after the clamped delay", func() bool { return live().Now > frozenAt })
+}
+
+// syncBuffer is a [bytes.Buffer] the record loop can write to while the test reads it.
+type syncBuffer struct {
+	lk  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
+
+// recordedFrom returns true if the recording has commands from player up to tick now included, ok is false if it doesn't go that far yet.
+func recordedFrom(t *testing.T, b []byte, player uint32, now state.Time) (found, ok bool) {
+	t.Helper()
+	r, err := replay.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return false, false
+	}
+	for {
+		tick, err := r.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, false
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tick.Now > now {
+			return found, true
+		}
+		for _, c := range tick.Commands {
+			found = found || c.Player == player
+		}
+	}
+}
+
+// replayTo simulates the recording from it's initial state up to tick now, it returns nil if it doesn't go that far yet.
+func replayTo(t *testing.T, b []byte, now state.Time) *state.State {
+	t.Helper()
+	r, err := replay.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+	s := new(state.State)
+	s.Copy(&r.Initial)
+	for s.Now < now {
+		tick, err := r.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tick.Apply(s)
+	}
+	return s
+}
+
+func TestManualClockReplay(t *testing.T) {
+	var recorded syncBuffer
+	g := newManualGame(t, 0, 1, Record(&recorded, replay.Metadata{}))
+	c, err := New(context.Background(), g.spares[0], nopFrontend{}, g.server.h.ID(), UseClock(g.clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.clients = append(g.clients, c)
+	waitFor(t, "the client to join", func() bool { return len(g.server.Stats().Remotes) == 1 })
+
+	g.step(state.TickRate)
+	c.Act(rpcgame.EncodeGivePlaneHeading(0, 4321))
+	g.step(state.TickRate)
+	waitFor(t, "the command to be commited", func() bool {
+		g.server.lk.Lock()
+		defer g.server.lk.Unlock()
+		planes := g.server.rollback.Commit.Planes
+		return len(planes) != 0 && planes[0].WantHeading == 4321
+	})
+	now, want := commitOf(g.server)
+
+	g.step(state.TickRate * 2) // the record loop flushes every second
+	var replayed *state.State
+	waitFor(t, "the replay to be written", func() bool {
+		replayed = replayTo(t, recorded.Bytes(), now)
+		return replayed != nil
+	})
+	if got := replayed.AppendMarshalBinary(nil); !bytes.Equal(got, want) {
+		t.Fatalf("replaying to tick %d diverged from the commited state", now)
+	}
+}
+
+// mispredictFrontend forwards the commands the netcode tells it were mispredicted.
+type mispredictFrontend struct {
+	nopFrontend
+	mispredicted chan rollback.Command
+}
+
+func (f mispredictFrontend) Mispredicted(c rollback.Command) { f.mispredicted <- c }
+
+func TestManualClockUnreliable(t *testing.T) {
+	hosts := newMocknet(t, 1)
+	f := mispredictFrontend{mispredicted: make(chan rollback.Command, 16)}
+	g := &manualGame{clock: manualclock.New()}
+	var err error
+	g.server, err = New(context.Background(), hosts[0], f, "", UseClock(g.clock), UnreliableHorizon(state.TickRate/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := g.server
+
+	g.step(state.TickRate * 2)
+	waitFor(t, "a plane to spawn", func() bool {
+		n.lk.Lock()
+		defer n.lk.Unlock()
+		return len(n.rollback.Live.Planes) != 0
+	})
+	live := func() (state.Time, rpcgame.Rot16) {
+		n.lk.Lock()
+		defer n.lk.Unlock()
+		return n.rollback.Live.Now, n.rollback.Live.Planes[0].WantHeading
+	}
+	joins := func() (count int) {
+		n.lk.Lock()
+		defer n.lk.Unlock()
+		for range n.rollback.Joins {
+			count++
+		}
+		return
+	}
+	now, before := live() // the clock only moves when we step, so Live stays at now
+	cmd := rpcgame.EncodeGivePlaneHeading(0, before+1234)
+
+	n.DoUnreliable(now-state.TickRate, 7, cmd)
+	n.DoUnreliable(now+maxUnreliableLead+1, 7, cmd)
+	n.DoUnreliable(now, 7, rpcgame.EncodePause(uint32(now+1)))
+	if c := joins(); c != 0 {
+		t.Fatalf("expected too old, too early and non mesh commands to be ignored; got %d commands", c)
+	}
+
+	n.DoUnreliable(now, 7, cmd)
+	if _, h := live(); h != before+1234 {
+		t.Fatalf("expected the unreliable command to be applied to Live; got heading %d", h)
+	}
+	g.step(state.TickRate)
+	select {
+	case c := <-f.mispredicted:
+		if c.Player != 7 || c.HappendAt != now || !bytes.Equal(c.Op.Bytes(), cmd.Bytes()) {
+			t.Fatalf("expected %v from player 7 at tick %d to be mispredicted; got %v from player %d at tick %d", cmd.OpCode(), now, c.Op.OpCode(), c.Player, c.HappendAt)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the command to be mispredicted")
+	}
+	if _, h := live(); h != before {
+		t.Fatalf("expected the mispredicted command to be removed from Live; got heading %d", h)
+	}
+
+	// a command which also arrives reliably is kept
+	now, _ = live()
+	cmd = rpcgame.EncodeGivePlaneHeading(0, before+4321)
+	n.DoUnreliable(now, 0, cmd)
+	n.Act(cmd)
+	g.step(state.TickRate)
+	waitFor(t, "the command to be commited", func() bool {
+		n.lk.Lock()
+		defer n.lk.Unlock()
+		return n.rollback.Commit.Now > now && n.rollback.Commit.Planes[0].WantHeading == before+4321
+	})
+	select {
+	case c := <-f.mispredicted:
+		t.Fatalf("expected the reliable command to not be mispredicted; got %v from player %d at tick %d", c.Op.OpCode(), c.Player, c.HappendAt)
+	default:
+	}
+}
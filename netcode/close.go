@@ -0,0 +1,149 @@
+package netcode
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+)
+
+var (
+	errClosed   = errors.New("closed")
+	errLeft     = errors.New("left the game")
+	errHostLeft = errors.New("the host left the game")
+)
+
+// closeGrace is how long [Netcode.Close] waits for the write loops to flush what is queued before saying farewell.
+const closeGrace = time.Second
+
+// Close leaves the game, it is also called once the context given to [New] is canceled.
+// The tick and render loops stop, what is queued is flushed, then peers are told why we leave, the server tells clients it is leaving so they don't reconnect.
+// It returns once all of our goroutines exited and the replay, if any, is written.
+func (n *Netcode) Close() error {
+	n.closeOnce.Do(func() { n.closeErr = n.close() })
+	return n.closeErr
+}
+
+func (n *Netcode) close() error {
+	if n.target == "" {
+		for proto := range n.protocols {
+			n.h.RemoveStreamHandler(proto)
+		}
+		n.h.RemoveStreamHandler(MeshProto)
+	}
+	n.cancel() // aborts dials and backoffs
+
+	n.lk.Lock()
+	n.closing = true
+	n.stateCond.Broadcast() // the render loop exits
+	for id := range n.meshPeers {
+		n.dropMeshPeer(id)
+	}
+	if s := n.meshStream; s != nil {
+		go s.Reset()
+	}
+
+	var expired bool
+	stop := n.clock.AfterFunc(closeGrace, func() {
+		n.lk.Lock()
+		defer n.lk.Unlock()
+		expired = true
+		n.sendCond.Broadcast()
+	})
+	for !expired && n.sendsPending() {
+		n.sendCond.Wait()
+	}
+	stop()
+
+	farewell := rpcgame.EncodeLeave()
+	if n.target == "" {
+		farewell = rpcgame.EncodeHostLeaving()
+	}
+	for p := range n.remotes {
+		p.farewell = &farewell
+		n.disconnect(p, errClosed)
+	}
+	n.lk.Unlock()
+
+	n.wg.Wait()
+
+	n.lk.Lock()
+	var b []byte
+	if n.recorder != nil {
+		b = n.recorder.Take()
+	}
+	n.lk.Unlock()
+	if b != nil {
+		if _, err := n.recordTo.Write(b); err != nil {
+			log.Println("error writing replay:", err)
+		}
+	}
+
+	if n.mesh != nil {
+		return n.mesh.Close()
+	}
+	return nil
+}
+
+// sendsPending returns true while a write loop still has something queued for it's peer or is writing it.
+// Must be called holding [n.lk].
+func (n *Netcode) sendsPending() bool {
+	for p := range n.remotes {
+		if p.err == nil && (n.sendBacklog(p) != 0 || p.writing) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrote is called by the write loops once their previous write, if any, is done.
+// Must be called holding [n.lk].
+func (n *Netcode) wrote(p *player) {
+	if p.writing && n.closing {
+		n.sendCond.Broadcast() // [Netcode.Close] waits for the writes in flight
+	}
+	p.writing = false
+}
+
+// spawn runs f in a new goroutine which [Netcode.Close] waits for, it returns false without running f once we are closing.
+// Must be called holding [n.lk].
+func (n *Netcode) spawn(f func()) bool {
+	if n.closing {
+		return false
+	}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// track is [Netcode.spawn] for goroutines we did not start, like the stream handlers, f runs on the calling goroutine.
+func (n *Netcode) track(f func()) bool {
+	n.lk.Lock()
+	if n.closing {
+		n.lk.Unlock()
+		return false
+	}
+	n.wg.Add(1)
+	n.lk.Unlock()
+	defer n.wg.Done()
+	f()
+	return true
+}
+
+// sleep waits for d, it returns false early if we are closing.
+// Unlike [Clock.Sleep] it is not for the tick loop, the manual clock of the tests doesn't count it as sleeping.
+func (n *Netcode) sleep(d time.Duration) bool {
+	wake := make(chan struct{})
+	stop := n.clock.AfterFunc(d, func() { close(wake) })
+	defer stop()
+	select {
+	case <-wake:
+		return true
+	case <-n.ctx.Done():
+		return false
+	}
+}
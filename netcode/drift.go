@@ -0,0 +1,58 @@
+package netcode
+
+import (
+	"time"
+
+	"github.com/Jorropo/OpenAirways/state"
+)
+
+const (
+	// waitPerTick is the nominal tick period.
+	waitPerTick = time.Second / state.TickRate
+
+	// maxDriftNudge bounds how much faster or slower than nominal the client ticks while correcting drift.
+	maxDriftNudge = .05
+	// driftGain is how much the period is nudged per tick of offset.
+	driftGain = .01
+	// driftDeadband is the offset under which we don't bother correcting, reports are only accurate to the tick.
+	driftDeadband = .5
+)
+
+// drift steers the client's tick period so it's live runs where the server wants it.
+// It does not read the time itself so it can be tested with a fake clock.
+type drift struct {
+	offset  float64 // smoothed, how many ticks we are ahead of where we should be
+	rate    float64 // learned, how much faster than the server our clock runs
+	ticks   float64 // ticks since the last sample
+	samples uint64
+}
+
+// sample records a measurement, ours is the position of our live and target where it should be, both in fractional ticks.
+func (d *drift) sample(ours, target float64) {
+	o := ours - target
+	if d.samples == 0 {
+		d.offset = o
+	} else {
+		// We predicted offset, if we are further ahead than that our clock runs faster than we thought.
+		residual := o - d.offset
+		if d.ticks != 0 {
+			d.rate = min(max(d.rate+residual/d.ticks/8, -maxDriftNudge), maxDriftNudge)
+		}
+		d.offset += residual / 8
+	}
+	d.ticks = 0
+	d.samples++
+}
+
+// next returns the period of our next tick.
+// Every tick we run nudged moves us relative to the server, it is accounted for right away so we don't overshoot waiting for the next sample to notice.
+func (d *drift) next() time.Duration {
+	nudge := d.rate
+	if d.offset <= -driftDeadband || d.offset >= driftDeadband {
+		nudge += d.offset * driftGain
+	}
+	nudge = min(max(nudge, -maxDriftNudge), maxDriftNudge)
+	d.offset -= nudge - d.rate // the rate part only compensates our clock's skew
+	d.ticks++
+	return time.Duration(float64(waitPerTick) * (1 + nudge))
+}
@@ -0,0 +1,89 @@
+package netcode
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// fakeClocks simulates a server ticking at the nominal rate and a client whose clock runs skew faster, using drift to correct it.
+type fakeClocks struct {
+	t      *testing.T
+	skew   float64
+	lead   float64
+	drift  drift
+	now    time.Duration // real time
+	client float64       // client live position in fractional ticks
+	period time.Duration // client tick period, in client time
+}
+
+func (f *fakeClocks) server() float64 {
+	return float64(f.now) / float64(waitPerTick)
+}
+
+func (f *fakeClocks) offset() float64 {
+	return f.client - (f.server() + f.lead)
+}
+
+// run advances real time by d in 1ms steps, the server reports it's live tick about every second.
+func (f *fakeClocks) run(d time.Duration) {
+	const step = time.Millisecond
+	for end := f.now + d; f.now < end; f.now += step {
+		if f.now%(time.Second+7*time.Millisecond) == 0 { // not aligned with ticks so we see every phase
+			// the server truncates to the tick, gotLiveTick assumes the middle.
+			f.drift.sample(f.client, math.Floor(f.server())+.5+f.lead)
+		}
+		before := math.Floor(f.client)
+		f.client += float64(step) * (1 + f.skew) / float64(f.period)
+		if math.Floor(f.client) != before {
+			// the tick loop picks up the period when it ticks.
+			f.period = f.drift.next()
+			if nudge := math.Abs(float64(f.period)/float64(waitPerTick) - 1); nudge > maxDriftNudge+1e-6 {
+				f.t.Fatalf("period %v is nudged by %.3f which is more than %.3f", f.period, nudge, maxDriftNudge)
+			}
+		}
+	}
+}
+
+func TestDriftCorrection(t *testing.T) {
+	for _, tc := range []struct {
+		skew    float64
+		initial float64 // ticks the client starts ahead of where it should be
+		lead    float64
+	}{
+		{skew: 0},
+		{skew: .01},
+		{skew: -.01},
+		{skew: .001, initial: -2, lead: 3}, // the server asked for a lead after we joined
+		{skew: -.02, initial: 10},
+	} {
+		t.Run(fmt.Sprintf("skew %v initial %v lead %v", tc.skew, tc.initial, tc.lead), func(t *testing.T) {
+			f := &fakeClocks{t: t, skew: tc.skew, lead: tc.lead, client: tc.lead + tc.initial, period: waitPerTick}
+			f.run(time.Minute)
+			if o := f.offset(); math.Abs(o) > 1 {
+				t.Fatalf("expected to be aligned within a tick after a minute; got %.2f", o)
+			}
+			// stays aligned
+			for range 10 {
+				f.run(time.Minute)
+				if o := f.offset(); math.Abs(o) > 1 {
+					t.Fatalf("drifted away by %.2f ticks after %v", o, f.now)
+				}
+			}
+		})
+	}
+}
+
+func TestDriftCorrectionIsBounded(t *testing.T) {
+	// A clock 10% off can't be fully corrected, we must still never tick more than maxDriftNudge faster.
+	f := &fakeClocks{t: t, skew: .1, period: waitPerTick}
+	f.run(time.Minute)
+	saturated := drift{offset: 1 / driftGain}
+	if f.period != saturated.next() {
+		t.Fatalf("expected the period to be saturated; got %v", f.period)
+	}
+	if f.offset() <= 0 {
+		t.Fatalf("expected the client to still be ahead; got %.2f", f.offset())
+	}
+}
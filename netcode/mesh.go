@@ -0,0 +1,223 @@
+package netcode
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	mrand "math/rand/v2"
+	"net/netip"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// MeshProto is used by clients to tell the server where they listen for the unreliable mesh and learn where the others do.
+//
+// The client sends its address once, then the server sends the full list of the other clients every time it changes.
+// Addresses are encoded as `u8` length + [netip.AddrPort.MarshalBinary], lists as `u8` count + `u32` player id and address pairs.
+const MeshProto protocol.ID = "/hhs/mesh/0.0"
+
+// maxMeshPeers is how many peers fit in a list, the mesh is allowed to be partial so we just send the first ones.
+const maxMeshPeers = 255
+
+// meshPeer is a client registered in the server's mesh directory.
+// All fields are protected by [Netcode.lk].
+type meshPeer struct {
+	player uint32
+	addr   netip.AddrPort
+	closed bool
+}
+
+func appendAddrPort(b []byte, a netip.AddrPort) []byte {
+	ab, _ := a.MarshalBinary() // never errors
+	b = append(b, byte(len(ab)))
+	return append(b, ab...)
+}
+
+func readAddrPort(r *bufio.Reader) (netip.AddrPort, error) {
+	l, err := r.ReadByte()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return netip.AddrPort{}, err
+	}
+	var a netip.AddrPort
+	if err := a.UnmarshalBinary(b); err != nil {
+		return netip.AddrPort{}, err
+	}
+	return a, nil
+}
+
+func (n *Netcode) handleMeshStreamAsServer(s network.Stream) error {
+	defer s.Reset()
+	r := bufio.NewReader(s)
+	addr, err := readAddrPort(r)
+	if err != nil {
+		return fmt.Errorf("reading mesh address: %w", err)
+	}
+	if !addr.IsValid() || addr.Port() == 0 {
+		return fmt.Errorf("invalid mesh address: %v", addr)
+	}
+	if addr.Addr().IsUnspecified() {
+		// They listen on all interfaces, use the IP they reach us with.
+		ip, err := manet.ToIP(s.Conn().RemoteMultiaddr())
+		if err != nil {
+			return fmt.Errorf("finding their IP: %w", err)
+		}
+		a, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			return fmt.Errorf("invalid remote IP: %v", ip)
+		}
+		addr = netip.AddrPortFrom(a.Unmap(), addr.Port())
+	}
+
+	remote := s.Conn().RemotePeer()
+	n.lk.Lock()
+	id := n.identities[remote]
+	if p, ok := n.players[id]; !ok || p.err != nil || p.spectator || p.s.Conn().RemotePeer() != remote || n.banned[remote] {
+		// the addresses of the others are only for players currently connected through the game stream, spectators don't send commands.
+		n.lk.Unlock()
+		return fmt.Errorf("mesh signaling from a peer which is not playing")
+	}
+	if n.closing {
+		n.lk.Unlock()
+		return errClosed
+	}
+	mp := &meshPeer{player: id, addr: addr}
+	if old, ok := n.meshPeers[remote]; ok {
+		old.closed = true // it's write loop will exit and reset it's stream
+	}
+	n.meshPeers[remote] = mp
+	n.meshGen++
+	n.meshCond.Broadcast()
+	n.spawn(func() {
+		// The client never sends anything else, reading lets us notice when it leaves.
+		io.Copy(io.Discard, r)
+		n.lk.Lock()
+		defer n.lk.Unlock()
+		mp.closed = true
+		if n.meshPeers[remote] == mp {
+			delete(n.meshPeers, remote)
+			n.meshGen++
+		}
+		n.meshCond.Broadcast()
+	})
+	n.lk.Unlock()
+
+	var sentGen uint64
+	var b []byte
+	for {
+		n.lk.Lock()
+		for n.meshGen == sentGen && !mp.closed {
+			n.meshCond.Wait()
+		}
+		if mp.closed {
+			n.lk.Unlock()
+			return nil
+		}
+		sentGen = n.meshGen
+		b = append(b[:0], 0)
+		for id, other := range n.meshPeers {
+			if id == remote {
+				continue
+			}
+			if b[0] == maxMeshPeers {
+				break
+			}
+			b[0]++
+			b = binary.LittleEndian.AppendUint32(b, other.player)
+			b = appendAddrPort(b, other.addr)
+		}
+		n.lk.Unlock()
+
+		if _, err := s.Write(b); err != nil {
+			return err
+		}
+	}
+}
+
+// dropMeshPeer closes the mesh signaling stream of peer id and tells the others to forget it.
+// Must be called holding [n.lk].
+func (n *Netcode) dropMeshPeer(id peer.ID) {
+	mp, ok := n.meshPeers[id]
+	if !ok {
+		return
+	}
+	mp.closed = true // it's write loop will exit and reset it's stream
+	delete(n.meshPeers, id)
+	n.meshGen++
+	n.meshCond.Broadcast()
+}
+
+// meshLoop registers our mesh address with the server and keeps our mesh peers up to date.
+// The mesh is optional so it retries forever, meanwhile everything goes through the reliable pipeline.
+func (n *Netcode) meshLoop() {
+	backoff := minReconnectBackoff
+	for {
+		n.lk.Lock()
+		stop := n.kicked || n.closing
+		n.lk.Unlock()
+		if stop {
+			return
+		}
+		established, err := n.meshSession()
+		n.mesh.SetPeers(nil)
+		log.Println("mesh signaling with:", n.target, "err:", err)
+		if established {
+			backoff = minReconnectBackoff
+		}
+		if !n.sleep(backoff + mrand.N(backoff/2)) {
+			return
+		}
+		backoff = min(backoff*2, maxReconnectBackoff)
+	}
+}
+
+func (n *Netcode) meshSession() (established bool, err error) {
+	ctx, cancel := context.WithTimeout(n.ctx, dialTimeout)
+	s, err := n.h.NewStream(ctx, n.target, MeshProto)
+	cancel()
+	if err != nil {
+		return false, fmt.Errorf("NewStream: %w", err)
+	}
+	defer s.Reset()
+	n.lk.Lock()
+	if n.closing {
+		n.lk.Unlock()
+		return false, errClosed
+	}
+	n.meshStream = s // [Netcode.Close] resets it to unblock us
+	n.lk.Unlock()
+
+	if _, err := s.Write(appendAddrPort(nil, n.mesh.LocalAddr())); err != nil {
+		return false, fmt.Errorf("writing our address: %w", err)
+	}
+
+	r := bufio.NewReader(s)
+	for {
+		count, err := r.ReadByte()
+		if err != nil {
+			return established, fmt.Errorf("reading peers: %w", err)
+		}
+		peers := make(map[uint32]netip.AddrPort, count)
+		for range count {
+			var id [4]byte
+			if _, err := io.ReadFull(r, id[:]); err != nil {
+				return established, fmt.Errorf("reading peers: %w", err)
+			}
+			peers[binary.LittleEndian.Uint32(id[:])], err = readAddrPort(r)
+			if err != nil {
+				return established, fmt.Errorf("reading peers: %w", err)
+			}
+		}
+		established = true
+		n.mesh.SetPeers(peers)
+	}
+}
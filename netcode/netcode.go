@@ -1,19 +1,26 @@
 // Very Cute code.
 //
-// This whole package lack buffer control and will hapily allocate infinte memory as it receives more data.
+// Package netcode keeps the game in sync between a server and it's clients with rollback, see NET.md.
 package netcode
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math"
 	mrand "math/rand/v2"
-	"os"
+	"net"
 	"sync"
 	"time"
 
+	"github.com/Jorropo/OpenAirways/mesh"
+	"github.com/Jorropo/OpenAirways/netsim"
+	"github.com/Jorropo/OpenAirways/replay"
 	"github.com/Jorropo/OpenAirways/rollback"
 	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
 	"github.com/Jorropo/OpenAirways/state"
@@ -23,11 +30,28 @@ import (
 	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
-const Proto protocol.ID = "/hhs/0.0"
-
-// release must be called when the renderer is done with the state
-// release must be called before blocking on anything else.
-type renderer func(state *state.State, release func())
+// Frontend displays the game to the local player.
+// It is never called concurrently nor while holding netcode locks.
+type Frontend interface {
+	// release must be called when the renderer is done with the state
+	// release must be called before blocking on anything else.
+	Render(state *state.State, release func())
+	// Mispredicted is called when an optimistic (unreliable) command was discarded because it never arrived reliably.
+	Mispredicted(cmd rollback.Command)
+	// Reconnecting is called before each attempt to connect again after we lost the server, attempt starts at 1 for each outage.
+	// Render is called again once we are back in the game.
+	Reconnecting(attempt uint32)
+	// Roster is called with every change to the roster and when the game starts, event is one of
+	// [rpcgame.RosterJoin], [rpcgame.RosterLeave], [rpcgame.RosterUpdate] or [rpcgame.GameStart].
+	// name is the payload of RosterUpdate, it is empty for the other events.
+	// Render is only called once the game started.
+	Roster(event rpcgame.Command, name string)
+	// Disconnected is called once when the host kicks us or leaves, event is [rpcgame.Kicked] or [rpcgame.HostLeaving].
+	// We don't reconnect and Render stops for good.
+	Disconnected(event rpcgame.Command)
+	// Chat is called with every chat message relayed by the server, ours included, see [rpcgame.EncodeChat].
+	Chat(player uint32, callout uint8, text []byte)
+}
 
 type Netcode struct {
 	// FIXME: this might be contentious, many only operate concurrent reads
@@ -36,12 +60,26 @@ type Netcode struct {
 
 	// Note: I use libp2p because it's convinient, might change to something more custom if it become hard (let's say WASM) or we need lower level timing control.
 	// I might change my mind and write a 100% custom UDP (& webrtc-unreliable) based proto instead of the optional unreliable shortcuts I have in mind.
-	h      host.Host
-	render renderer
-	target peer.ID // if empty then we are the server
+	h        host.Host
+	frontend Frontend
+	clock    Clock
+	target   peer.ID // if empty then we are the server
+
+	ctx       context.Context // canceled by [Netcode.Close]
+	cancel    context.CancelFunc
+	closing   bool           // loops exit and nothing new starts
+	wg        sync.WaitGroup // the goroutines [Netcode.Close] waits for, see [Netcode.spawn]
+	closeOnce sync.Once
+	closeErr  error
 
 	stateCond              sync.Cond
 	rollback               rollback.Rollback
+	mispredicted           []rollback.Command // waiting to be given to the frontend
+	reconnecting           []uint32           // attempts waiting to be given to the frontend
+	rosterEvents           []rosterEvent      // waiting to be given to the frontend
+	chatEvents             []chatMessage      // waiting to be given to the frontend
+	disconnected           *rpcgame.Command   // Kicked or HostLeaving waiting to be given to the frontend
+	renderLoopOnce         sync.Once
 	commitWaitingOnPlayers []playersBlockingCommits // TODO: ring buffer this
 	playersBlockingCommits uint32
 
@@ -50,6 +88,211 @@ type Netcode struct {
 	sendGen              uint64 // holds the generation of the last packet before send[0], else they are relative based on index
 	playersWaitingOnSend uint32
 	totalPlayers         uint32 // monotonically increasing player ids
+
+	recvCommands uint64 // commands read by the receive loops
+	recvBatches  uint64 // times the receive loops took the lock to handle what they read
+
+	players    map[uint32]*player           // server only
+	identities map[peer.ID]uint32           // server only, players reconnecting keep their id
+	banned     map[peer.ID]bool             // server only, refused for the rest of the session
+	allowed    map[peer.ID]bool             // server only, nil allows everyone
+	password   string                       // the room password, clients send theirs
+	version    version                      // the one we give in the handshake, only changed by tests, the protocol version comes from protocols
+	protocols  map[protocol.ID]gameProtocol // the versions of the game stream we speak, only changed by tests
+	server     *player                      // client only, replaced on reconnection
+	kicked     bool                         // client only, the server told us to not reconnect
+	id         uint32                       // our player id, the server is always 0, clients learn theirs in the handshake
+
+	roster     map[uint32]*RosterEntry // the server's, mirrored by clients
+	name       string                  // client only, ours, sent again after reconnecting
+	ready      bool                    // client only
+	lobby      bool                    // server only, the simulation waits for everyone to be ready before ticking
+	minPlayers uint32                  // server only
+	started    bool                    // the simulation is ticking, false while in the lobby
+	startedAt  time.Time               // client only, our estimate of when the server left the lobby
+	spectator  bool                    // client only, we only watch the game
+	ownership  bool                    // server only, planes are split between the players in the roster
+
+	resumeDelay state.Time
+	resumeAt    time.Time // when the tick loop restarts after a pause
+
+	chatRate       float64       // server only, chat messages per second a player can sustain, zero disables the limit
+	chatBurst      float64       // server only
+	chatHistory    []chatMessage // server only, the latest messages, players joining get them
+	maxChatHistory int           // server only
+	chatDropped    uint64        // server only, messages over the rate limit
+
+	maxSendBacklog    uint64
+	maxCommitLag      state.Time
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	heartbeatInterval time.Duration
+	pingInterval      time.Duration
+	clockSyncInterval time.Duration
+	netsim            netsim.Conditions
+
+	drift      drift         // client only
+	lastTickAt time.Time     // client only, when the tick loop last ticked live, zero until the first tick of a session
+	tickPeriod time.Duration // client only, the period the tick loop currently runs at
+
+	recordTo   io.Writer
+	recordMeta replay.Metadata
+	recorder   *replay.Recorder // nil if we are not recording
+
+	meshConn   net.PacketConn        // client only, nil if we don't join the mesh
+	mesh       *mesh.Mesh            // client only
+	meshStream network.Stream        // client only, the signaling stream of the current mesh session
+	meshCond   sync.Cond             // server only
+	meshPeers  map[peer.ID]*meshPeer // server only
+	meshGen    uint64                // server only, bumped every time meshPeers changes
+}
+
+// player is a remote peer, on the server there is one per connected client, on the client there is one for the server.
+// All fields are protected by [Netcode.lk].
+type player struct {
+	id          uint32
+	s           network.Stream
+	lastSentGen uint64     // generation up to which the write loop consumed [Netcode.send]
+	ownPending  uint64     // server only, packets from this player in [Netcode.send] not yet consumed by its write loop, they wont be sent back to it
+	remoteNow   state.Time // server only, the tick the player will send inputs for next
+
+	lastRead     time.Time // when we last received something from this player, or when it connected
+	lastWrite    time.Time // when the write loop last started writing to this player
+	writing      bool      // the write loop is blocked writing to this player since lastWrite
+	heartbeatDue bool      // the write loop must send a heartbeat if it has nothing else to send
+
+	rtt          rtt
+	pingDue      bool // the write loop must send a ping
+	pingInFlight bool
+	pingSeq      uint32    // sequence of the last ping sent
+	pingSentAt   time.Time // when the last ping was sent
+	pongDue      bool      // the write loop must answer pongSeq
+	pongSeq      uint32
+	lead         state.Time // how many ticks ahead of the server the client should run, on the server the last one sent
+	leadDue      bool       // server only, the write loop must send lead
+
+	liveTickDue    bool      // server only, the write loop must send our live tick
+	liveTickSentAt time.Time // server only
+	rosterDue      bool      // client only, the write loop must send our name and ready state
+	spectator      bool      // server only, it never blocks commits nor sends commands
+	chatTokens     float64   // server only, chat rate limit
+	chatRefilledAt time.Time // server only
+
+	farewell         *rpcgame.Command // the write loop sends it before resetting the stream, like Kicked
+	recvDone         chan struct{}    // closed once the receive loop exited
+	err              error            // non nil once the player has been disconnected
+	readEdgeCleaned  bool
+	writeEdgeCleaned bool
+}
+
+const (
+	DefaultMaxSendBacklog    = 4096
+	DefaultMaxCommitLag      = state.TickRate * 10
+	DefaultReadTimeout       = 10 * time.Second
+	DefaultWriteTimeout      = 10 * time.Second
+	DefaultHeartbeatInterval = time.Second
+	DefaultPingInterval      = time.Second
+	DefaultClockSyncInterval = time.Second
+	DefaultChatRate          = 1
+	DefaultChatBurst         = 5
+	DefaultChatHistory       = 50
+	DefaultResumeDelay       = state.TickRate * 3
+)
+
+type Option func(*Netcode)
+
+// MaxSendBacklog sets how many packets can be waiting to be sent to a single peer before it is disconnected.
+func MaxSendBacklog(packets uint64) Option {
+	return func(n *Netcode) {
+		n.maxSendBacklog = packets
+	}
+}
+
+// MaxCommitLag sets how many ticks Live can run ahead of Commit.
+// On the server players blocking commits for longer, or running further ahead of the server than this, are disconnected.
+// On the client, the server is disconnected if it does not commit for this long.
+// This bounds the rollback buffer and the commit queue.
+func MaxCommitLag(ticks state.Time) Option {
+	return func(n *Netcode) {
+		n.maxCommitLag = ticks
+	}
+}
+
+// ReadTimeout sets how long a peer can stay silent before being disconnected.
+// It should be a few times bigger than the remote's heartbeat interval. Zero disables it.
+func ReadTimeout(d time.Duration) Option {
+	return func(n *Netcode) {
+		n.readTimeout = d
+	}
+}
+
+// WriteTimeout sets how long a single write to a peer can block before it is disconnected. Zero disables it.
+func WriteTimeout(d time.Duration) Option {
+	return func(n *Netcode) {
+		n.writeTimeout = d
+	}
+}
+
+// HeartbeatInterval sets after how long without writing anything to a peer we send it a heartbeat. Zero disables heartbeats.
+func HeartbeatInterval(d time.Duration) Option {
+	return func(n *Netcode) {
+		n.heartbeatInterval = d
+	}
+}
+
+// PingInterval sets how often we measure the round trip time to peers. Zero disables it.
+func PingInterval(d time.Duration) Option {
+	return func(n *Netcode) {
+		n.pingInterval = d
+	}
+}
+
+// ClockSyncInterval sets how often the server reports it's live tick to clients so they can correct their clock drift. Zero disables it.
+// Clients run their tick loop slightly faster or slower to stay [RemoteStats.Lead] ticks ahead of it.
+func ClockSyncInterval(d time.Duration) Option {
+	return func(n *Netcode) {
+		n.clockSyncInterval = d
+	}
+}
+
+// SimulateNetwork applies c to both directions of our game streams, see [netsim].
+// On the server it applies to every client, on a client only to it's link with the server.
+func SimulateNetwork(c netsim.Conditions) Option {
+	return func(n *Netcode) {
+		n.netsim = c
+	}
+}
+
+// UseClock replaces the time source, tests use it to step time manually.
+func UseClock(c Clock) Option {
+	return func(n *Netcode) {
+		n.clock = c
+	}
+}
+
+// UnreliableHorizon sets how many ticks unreliable commands can stay in the rollback buffer before being discarded if they were not received reliably.
+// Zero keeps them until commit.
+func UnreliableHorizon(ticks state.Time) Option {
+	return func(n *Netcode) {
+		n.rollback.UnreliableHorizon = ticks
+	}
+}
+
+// UnreliableMesh makes the client join the unreliable mesh with other clients using c.
+// Our commands are also sent directly to the other clients and theirs are applied optimistically when received before the server relays them.
+// [Netcode.Close] closes c.
+func UnreliableMesh(c net.PacketConn) Option {
+	return func(n *Netcode) {
+		n.meshConn = c
+	}
+}
+
+// Record makes the server write a replay of the commited game to w.
+func Record(w io.Writer, meta replay.Metadata) Option {
+	return func(n *Netcode) {
+		n.recordTo = w
+		n.recordMeta = meta
+	}
 }
 
 func (n *Netcode) lastSentGen() uint64 {
@@ -61,6 +304,7 @@ type sent struct {
 	stillBlockedOnSend uint32
 	when               state.Time
 	cmd                rpcgame.Command
+	payload            []byte // variably sized commands only
 }
 
 func (s *sent) decrementStillBlockedOnSend() {
@@ -72,16 +316,70 @@ func (s *sent) decrementStillBlockedOnSend() {
 
 // New creates and run a new netcode instance.
 // If target is zero we run as a server.
-// render will not be called concurrently.
-func New(h host.Host, render renderer, target peer.ID) (*Netcode, error) {
+// It runs until [Netcode.Close] is called or ctx is canceled, ctx also bounds connecting to the server.
+// Clients losing the server reconnect with backoff and resume from the server's commited state, the server gives them back the same player id.
+func New(ctx context.Context, h host.Host, frontend Frontend, target peer.ID, opts ...Option) (*Netcode, error) {
 	n := &Netcode{
 		h:            h,
-		render:       render,
+		frontend:     frontend,
+		clock:        realClock{},
 		target:       target,
 		totalPlayers: 1, // playerId 0 is always us
+
+		players:    make(map[uint32]*player),
+		identities: make(map[peer.ID]uint32),
+		banned:     make(map[peer.ID]bool),
+		meshPeers:  make(map[peer.ID]*meshPeer),
+		roster:     make(map[uint32]*RosterEntry),
+
+		maxSendBacklog:    DefaultMaxSendBacklog,
+		maxCommitLag:      DefaultMaxCommitLag,
+		readTimeout:       DefaultReadTimeout,
+		writeTimeout:      DefaultWriteTimeout,
+		heartbeatInterval: DefaultHeartbeatInterval,
+		pingInterval:      DefaultPingInterval,
+		clockSyncInterval: DefaultClockSyncInterval,
+		chatRate:          DefaultChatRate,
+		chatBurst:         DefaultChatBurst,
+		maxChatHistory:    DefaultChatHistory,
+		resumeDelay:       DefaultResumeDelay,
+		version:           currentVersion,
+		protocols:         maps.Clone(gameProtocols),
+	}
+	for _, o := range opts {
+		o(n)
+	}
+	if n.recordTo != nil && n.target != "" {
+		return nil, fmt.Errorf("recording is only supported on the server")
+	}
+	if n.meshConn != nil && n.target == "" {
+		return nil, fmt.Errorf("the unreliable mesh is only between clients")
+	}
+	if n.lobby && n.target != "" {
+		return nil, fmt.Errorf("the lobby is decided by the server")
+	}
+	if len(n.password) > math.MaxUint8 {
+		return nil, fmt.Errorf("password is %d bytes long, the maximum is %d", len(n.password), math.MaxUint8)
+	}
+	if n.allowed != nil && n.target != "" {
+		return nil, fmt.Errorf("the allowed peers are decided by the server")
+	}
+	if n.ownership && n.target != "" {
+		return nil, fmt.Errorf("plane ownership is decided by the server")
+	}
+	if n.spectator && n.target == "" {
+		return nil, fmt.Errorf("only clients can spectate")
+	}
+	if n.spectator && n.meshConn != nil {
+		return nil, fmt.Errorf("spectators don't join the unreliable mesh")
 	}
 	n.stateCond.L = &n.lk
 	n.sendCond.L = &n.lk
+	n.meshCond.L = &n.lk
+	n.rollback.OnDiscard = func(c rollback.Command) {
+		n.mispredicted = append(n.mispredicted, c)
+		n.stateCond.Broadcast()
+	}
 
 	n.rollback.Commit.MapSize = state.Rect{X: -960, Y: -540, W: 1920, H: 1080}
 	n.rollback.Commit.CameraSize = state.Rect{X: -480, Y: -270, W: 960, H: 540}
@@ -96,61 +394,169 @@ func New(h host.Host, render renderer, target peer.ID) (*Netcode, error) {
 		}
 		n.rollback.Commit.Runways = append(n.rollback.Commit.Runways, r)
 	}
+	if n.ownership {
+		n.rollback.Commit.Controllers = []uint32{0} // the others are added through rollback as they join.
+	}
 	n.rollback.Live.Copy(&n.rollback.Commit)
+	n.ctx, n.cancel = context.WithCancel(ctx)
 
 	if n.target == "" {
-		h.SetStreamHandler(Proto, func(s network.Stream) {
-			c := s.Conn()
-			log.Println("new connection", c.RemotePeer(), c.RemoteMultiaddr())
-
-			if err := n.handleStreamAsServer(s); err != nil {
-				log.Println(c.RemotePeer(), "stream error:", err)
+		for proto, p := range n.protocols {
+			h.SetStreamHandler(proto, func(s network.Stream) {
+				c := s.Conn()
+				log.Println("new connection", c.RemotePeer(), c.RemoteMultiaddr(), proto)
+
+				if !n.track(func() {
+					if err := p.handle(n, s); err != nil {
+						log.Println(c.RemotePeer(), "stream error:", err)
+					}
+				}) {
+					s.Reset()
+				}
+			})
+		}
+		h.SetStreamHandler(MeshProto, func(s network.Stream) {
+			if !n.track(func() {
+				if err := n.handleMeshStreamAsServer(s); err != nil {
+					log.Println(s.Conn().RemotePeer(), "mesh stream error:", err)
+				}
+			}) {
+				s.Reset()
 			}
 		})
 		n.rollback.Live.Tick() // start with live in the future, commit must trail in the past.
-		go n.tickLoop(time.Now(), 0)
-		go n.renderLoop()
+		n.roster[0] = &RosterEntry{ID: 0}
+		n.started = !n.lobby
+		n.lk.Lock()
+		if n.recordTo != nil {
+			n.recorder = replay.NewRecorder(n.recordMeta, &n.rollback.Commit)
+			n.recorder.PlayerJoined(replay.Player{ID: 0})
+			n.spawn(n.recordLoop)
+		}
+		start := n.clock.Now()
+		n.spawn(func() { n.tickLoop(start, 0, nil) })
+		n.spawn(n.renderLoop)
+		n.lk.Unlock()
 	} else {
 		if err := n.startupClientStreams(); err != nil {
+			n.cancel()
 			return nil, fmt.Errorf("startupClientStreams: %w", err)
 		}
+		if n.meshConn != nil {
+			n.mesh = mesh.New(n.meshConn, n.DoUnreliable)
+			n.lk.Lock()
+			n.spawn(n.meshLoop)
+			n.lk.Unlock()
+		}
 	}
+	context.AfterFunc(ctx, func() { n.Close() })
 
 	return n, nil
 }
 
 func (n *Netcode) startupClientStreams() error {
-	s, err := n.h.NewStream(context.TODO(), n.target, Proto)
+	hs, err := n.dialServer()
+	if err != nil {
+		return err
+	}
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.resume(hs)
+	return nil
+}
+
+const (
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 5 * time.Second
+	dialTimeout         = 10 * time.Second
+)
+
+// handshake is what the client learns from the server when connecting.
+type handshake struct {
+	s       network.Stream
+	commit  *state.State // the server's commited state
+	live    state.Time   // the tick the server will be waiting inputs for
+	start   time.Time    // when we estimate the server started live
+	id      uint32       // our player id, the server stamps it on the commands it relays from us
+	started bool         // false if the server is still in the lobby
+}
+
+// dialServer opens a stream to the server and does the handshake.
+func (n *Netcode) dialServer() (_ handshake, err error) {
+	ctx, cancel := context.WithTimeout(n.ctx, dialTimeout)
+	defer cancel()
+	offer := n.offer()
+	s, err := n.h.NewStream(ctx, n.target, offer...)
 	if err != nil {
-		return fmt.Errorf("NewStream: %w", err)
+		return handshake{}, fmt.Errorf("opening the game stream, we speak %v: %w", offer, err)
+	}
+	if !n.netsim.IsZero() {
+		s = netsim.Wrap(s, n.netsim, n.clock)
 	}
-	var good bool
 	defer func() {
-		if !good {
+		if err != nil {
 			s.Reset()
 		}
 	}()
+	if n.readTimeout != 0 {
+		// we aren't tracked by the read loop timeouts yet, not all transports support deadlines so do it by hand.
+		stop := n.clock.AfterFunc(n.readTimeout, func() { s.Reset() })
+		defer stop()
+	}
 
-	_, err = n.rollback.Commit.Read(s)
+	role := rolePlayer
+	if n.spectator {
+		role = roleSpectator
+	}
+	if _, err := s.Write(n.appendHello(nil, s.Protocol(), role)); err != nil {
+		return handshake{}, fmt.Errorf("writing hello: %w", err)
+	}
+	theirs, err := readVersion(s)
 	if err != nil {
-		return fmt.Errorf("Reading commit state: %w", err)
+		return handshake{}, err
+	}
+	if err := readAdmission(s); err != nil {
+		return handshake{}, err
+	}
+	if ours := n.versionOn(s.Protocol()); ours.compatible(theirs) != nil {
+		// they should have rejected us.
+		return handshake{}, &RejectedError{Reason: fmt.Sprintf("admitted us with version %+v while we run %+v", theirs, ours)}
+	}
+
+	commit := new(state.State)
+	_, err = commit.Read(s)
+	if err != nil {
+		return handshake{}, fmt.Errorf("Reading commit state: %w", err)
 	}
-	n.rollback.Live.Copy(&n.rollback.Commit)
 
 	// Estimating latency.
-	start := time.Now()
-	var theirLive [4]byte
-	_, err = s.Write(theirLive[:1])
+	start := n.clock.Now()
+	var timing [9]byte // their live u32 + our player id u32 + started u8
+	_, err = s.Write(timing[:1])
 	if err != nil {
-		return fmt.Errorf("writing timing: %w", err)
+		return handshake{}, fmt.Errorf("writing timing: %w", err)
 	}
-	_, err = io.ReadFull(s, theirLive[:])
+	_, err = io.ReadFull(s, timing[:])
 	if err != nil {
-		return fmt.Errorf("reading timing: %w", err)
+		return handshake{}, fmt.Errorf("reading timing: %w", err)
 	}
-	live := state.Time(binary.LittleEndian.Uint32(theirLive[:]))
-	oneWayLatency := time.Since(start) / 2
-	start = start.Add(oneWayLatency) // catchup to their time
+	oneWayLatency := n.clock.Now().Sub(start) / 2
+	return handshake{
+		s:       s,
+		commit:  commit,
+		live:    state.Time(binary.LittleEndian.Uint32(timing[:])),
+		start:   start.Add(oneWayLatency), // catchup to their time
+		id:      binary.LittleEndian.Uint32(timing[4:]),
+		started: timing[8] != 0,
+	}, nil
+}
+
+// resume starts a new session with the server, throwing away whatever we had before.
+// Must be called holding [n.lk].
+func (n *Netcode) resume(hs handshake) {
+	s, live := hs.s, hs.live
+	n.id = hs.id
+	n.rollback.Reset(hs.commit)
 	for range live - n.rollback.Commit.Now {
 		n.rollback.Live.Tick()
 	}
@@ -158,82 +564,254 @@ func (n *Netcode) startupClientStreams() error {
 		panic("didn't caught up to expected value")
 	}
 
+	// Packets queued for the previous session are lost, nothing waits on them since it's write edge was cleaned up.
+	n.sendGen = n.lastSentGen()
+	n.send = nil
+
+	n.drift = drift{}
+	n.lastTickAt = time.Time{}
+	n.tickPeriod = waitPerTick
+
+	n.started = hs.started
+	n.startedAt = hs.start
+	for id := range n.roster {
+		// the server sends us it's whole roster again.
+		delete(n.roster, id)
+		n.rosterChanged(rpcgame.EncodeRosterLeave(id), "")
+	}
+
 	n.playersWaitingOnSend++ // the server waits our messages
+	now := n.clock.Now()
+	p := &player{s: s, lastSentGen: n.lastSentGen(), lastRead: now, lastWrite: now, rosterDue: !n.spectator && (n.name != "" || n.ready), recvDone: make(chan struct{})}
+	n.server = p
+	n.stateCond.Broadcast()
+
+	n.spawn(func() { n.tickLoop(hs.start, live, p) })
+	n.spawn(func() { n.clientSendLoop(p, live) })
+	n.spawn(func() { n.clientRecvLoop(p) })
+}
 
-	go n.tickLoop(start, live)
-	go n.clientSendLoop(s, live)
-	go n.clientRecvLoop(s)
-	good = true
-	return nil
+// reconnect dials the server again with exponential backoff until it succeeds, then resumes the game from the server's commited state.
+func (n *Netcode) reconnect() {
+	backoff := minReconnectBackoff
+	for attempt := uint32(1); ; attempt++ {
+		n.lk.Lock()
+		n.reconnecting = append(n.reconnecting, attempt)
+		n.stateCond.Broadcast()
+		n.lk.Unlock()
+
+		hs, err := n.dialServer()
+		if err == nil {
+			n.lk.Lock()
+			if n.closing {
+				n.lk.Unlock()
+				hs.s.Reset()
+				return
+			}
+			n.resume(hs)
+			n.lk.Unlock()
+			log.Println("reconnected to:", n.target, "after", attempt, "attempts")
+			return
+		}
+		log.Println("reconnecting to:", n.target, "attempt", attempt, "err:", err)
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			n.lk.Lock()
+			n.kicked = true // the mesh stops too
+			n.lk.Unlock()
+			return
+		}
+
+		if !n.sleep(backoff + mrand.N(backoff/2)) { // jitter so clients of a restarting server don't all come back at once.
+			return
+		}
+		backoff = min(backoff*2, maxReconnectBackoff)
+	}
 }
 
-func (n *Netcode) clientRecvLoop(s network.Stream) {
+func (n *Netcode) clientRecvLoop(p *player) {
+	defer close(p.recvDone)
+	s := p.s
 	if err := func() error {
 		defer s.Reset()
+		return n.clientRecv(p, bufio.NewReader(s))
+	}(); err != nil {
+		log.Println("error in receive loop from:", s.Conn().RemotePeer(), "err:", err)
+		n.lk.Lock()
+		n.disconnect(p, err)
+		n.lk.Unlock()
+	}
+}
 
-		var buf rpcgame.Command
-		for {
-			// FIXME: s.SetReadDeadline
-			_, err := io.ReadFull(s, buf[:4])
-			if err != nil {
-				return fmt.Errorf("reading opcode: %w", err)
+// timedCommand is a command from the server along with the tick it happens at and the player it comes from.
+type timedCommand struct {
+	when    state.Time
+	player  uint32
+	cmd     rpcgame.Command
+	payload []byte // variably sized commands only
+}
+
+// clientRecv reads commands from the server until an error happens.
+// Everything already buffered is handled under a single lock and given to [rollback.Rollback.Do] together so a Head-Of-Line burst replays once.
+func (n *Netcode) clientRecv(p *player, r *bufio.Reader) error {
+	var batch []timedCommand
+	var pending []rollback.Command
+	var header [8]byte // when u32 + player u32
+	for {
+		batch = batch[:0]
+		var readErr error
+		for len(batch) == 0 || (len(batch) < maxRecvBatch && commandBuffered(r, len(header))) {
+			if _, err := io.ReadFull(r, header[:]); err != nil {
+				readErr = fmt.Errorf("reading header: %w", err)
+				break
 			}
-			when := state.Time(binary.LittleEndian.Uint32(buf[:]))
-			_, err = io.ReadFull(s, buf[:2])
-			if err != nil {
-				return fmt.Errorf("reading opcode: %w", err)
+			c := timedCommand{
+				when:   state.Time(binary.LittleEndian.Uint32(header[:])),
+				player: binary.LittleEndian.Uint32(header[4:]),
 			}
-			op := rpcgame.OpCode(binary.LittleEndian.Uint16(buf[:]))
-			sz, ok := op.Size()
-			if !ok {
-				return fmt.Errorf("sent us invalid opcode: %v", op)
+			if err := rpcgame.ServerToClient.Read(r, &c.cmd); err != nil {
+				readErr = err
+				break
 			}
-			if sz > 2 {
-				_, err = io.ReadFull(s, buf[2:sz])
-				if err != nil {
-					return fmt.Errorf("reading payload %v: %w", op, err)
-				}
+			var err error
+			if c.payload, err = rpcgame.ReadPayload(r, &c.cmd); err != nil {
+				readErr = err
+				break
 			}
+			batch = append(batch, c)
+		}
+		if len(batch) == 0 {
+			return readErr
+		}
 
-			// FIXME: we can optimize this, instead of handling packet by packet we can batch with bufio.Reader and r.Buffered(), would create less sync events after Head-Of-Line event.
-			// FIXME: use RPC namespaces in to sanitize allowed RPC calls.
-
-			n.lk.Lock()
-			switch op {
+		n.lk.Lock()
+		if p.err != nil {
+			// we got replaced by a new session, don't touch the new rollback state.
+			n.lk.Unlock()
+			return p.err
+		}
+		now := n.clock.Now()
+		p.lastRead = now
+		n.recvBatches++
+		n.recvCommands += uint64(len(batch))
+		for _, c := range batch {
+			buf := c.cmd
+			switch buf.OpCode() {
+			case rpcgame.ServerHeartbeat:
+			case rpcgame.ServerPing:
+				n.gotPing(p, binary.LittleEndian.Uint32(buf[2:]))
+			case rpcgame.ServerPong:
+				n.gotPong(p, binary.LittleEndian.Uint32(buf[2:]), now)
+			case rpcgame.Lead:
+				p.lead = state.Time(binary.LittleEndian.Uint32(buf[2:]))
+			case rpcgame.LiveTick:
+				n.gotLiveTick(p, state.Time(binary.LittleEndian.Uint32(buf[2:])), now)
+			case rpcgame.RosterJoin, rpcgame.RosterLeave, rpcgame.RosterUpdate:
+				if err := n.gotRosterUpdate(buf, c.payload); err != nil {
+					pending = n.applyBatch(pending)
+					n.lk.Unlock()
+					return err
+				}
+			case rpcgame.GameStart:
+				n.gotGameStart(p, now)
+			case rpcgame.ChatMessage:
+				n.gotChatMessage(buf, c.payload)
+			case rpcgame.Kicked, rpcgame.HostLeaving:
+				pending = n.applyBatch(pending)
+				n.gotKicked(buf)
+				n.lk.Unlock()
+				if buf.OpCode() == rpcgame.HostLeaving {
+					return errHostLeft
+				}
+				return errKicked
 			case rpcgame.CommitTick:
-				if when != n.rollback.Commit.Now {
-					panic(fmt.Sprintf("inconsistent commit tick state, expected %d; got %d", when, n.rollback.Commit.Now))
+				pending = n.applyBatch(pending) // the commands of this tick must be in before it is commited.
+				if c.when != n.rollback.Commit.Now {
+					panic(fmt.Sprintf("inconsistent commit tick state, expected %d; got %d", c.when, n.rollback.Commit.Now))
+				}
+				if n.spectator && n.rollback.Commit.Now+1 >= n.rollback.Live.Now {
+					// we don't block commits, if our tick loop is a bit late the server can commit the tick we are on.
+					n.rollback.TickLive()
 				}
 				n.rollback.TickCommit()
+			case rpcgame.Resume:
+				n.scheduleResume(buf, now.Add(-p.rtt.srtt/2))
+				pending = append(pending, rollback.Command{Op: buf, Player: c.player, Reliable: true, HappendAt: c.when})
 			default:
-				if n.rollback.Do(rollback.Command{Op: buf, Reliable: true, HappendAt: when}) {
-					n.stateCond.Broadcast()
-				}
+				pending = append(pending, rollback.Command{Op: buf, Player: c.player, Reliable: true, HappendAt: c.when})
 			}
+		}
+		pending = n.applyBatch(pending)
+		if err := n.missedPause(); err != nil {
 			n.lk.Unlock()
+			return err
 		}
-	}(); err != nil {
-		log.Println("error in receive loop from:", s.Conn().RemotePeer(), "err:", err)
-		os.Exit(1)
+		n.lk.Unlock()
+
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// maxRecvBatch bounds how many commands a receive loop handles per lock acquisition so a flood doesn't starve the tick loop.
+const maxRecvBatch = 256
+
+// commandBuffered returns true if a whole command, after skip bytes of header, can be read from r without blocking.
+func commandBuffered(r *bufio.Reader, skip int) bool {
+	if r.Buffered() < skip+2 {
+		return false
+	}
+	b, _ := r.Peek(skip + 2)
+	size, ok := rpcgame.OpCode(binary.LittleEndian.Uint16(b[skip:])).Size()
+	if !ok {
+		return true // reading it errors right away
 	}
+	if uint(r.Buffered()) < uint(skip)+size {
+		return false
+	}
+	b, _ = r.Peek(skip + int(size))
+	var c rpcgame.Command
+	copy(c[:], b[skip:])
+	return uint(r.Buffered()) >= uint(skip)+size+c.PayloadSize()
+}
+
+// applyBatch gives pending to [rollback.Rollback.Do] in one call, so commands in the past of live only replay once.
+// It returns pending emptied for reuse.
+// Must be called holding [n.lk].
+func (n *Netcode) applyBatch(pending []rollback.Command) []rollback.Command {
+	if len(pending) != 0 && n.rollback.Do(pending...) {
+		n.stateCond.Broadcast()
+	}
+	return pending[:0]
 }
 
 // clientSendLoop is the main loop for sending packets to the server.
 // sendTime is used because unlike in the server to client protocol when the server sends timing before each packet,
 // the client to server protocol use implicit packets based on ordering, CommitTick implies a bump.
-func (n *Netcode) clientSendLoop(s network.Stream, sendTime state.Time) {
+func (n *Netcode) clientSendLoop(p *player, sendTime state.Time) {
+	s := p.s
 	if err := func() error {
 		defer s.Reset()
 
 		var reuse []byte
-		var lastSentGen uint64 // always start at zero for client
 		for {
 			n.lk.Lock()
-			for n.lastSentGen() == lastSentGen {
+			n.wrote(p)
+			for n.lastSentGen() == p.lastSentGen && p.err == nil && !p.metaDue() {
 				n.sendCond.Wait()
 			}
-			p := reuse[:0]
-			for i := lastSentGen - n.sendGen; i < uint64(len(n.send)); i++ {
+			if err := p.err; err != nil {
+				var b []byte
+				if p.farewell != nil {
+					b = p.farewell.Bytes()
+				}
+				n.lk.Unlock()
+				sayFarewell(s, p, b)
+				return err
+			}
+			b := reuse[:0]
+			for i := p.lastSentGen - n.sendGen; i < uint64(len(n.send)); i++ {
 				n.send[i].decrementStillBlockedOnSend()
 				todo := n.send[i]
 
@@ -245,36 +823,72 @@ func (n *Netcode) clientSendLoop(s network.Stream, sendTime state.Time) {
 					panic(fmt.Sprintf("trying to send packets out of order to the server: %v %#+v", sendTime, todo))
 				}
 
-				p = append(p, todo.cmd.Bytes()...)
+				b = append(b, todo.cmd.Bytes()...)
+				b = append(b, todo.payload...)
 			}
 			n.cleanupSends()
-			lastSentGen = n.lastSentGen()
+			p.lastSentGen = n.lastSentGen()
+			b = n.beginWrite(p, b)
 			n.lk.Unlock()
 
-			if len(p) == 0 {
+			if len(b) == 0 {
 				// don't bother trying to write if none of the packet were sendable.
 				// For example, let's say this player sent a reliable packet and this was the only packet we got woken up for, we wont send them anything else.
 			} else {
-				// FIXME: s.SetWriteDeadline
-
-				if _, err := s.Write(p); err != nil {
+				if _, err := s.Write(b); err != nil {
 					return err
 				}
 			}
 		}
 	}(); err != nil {
-		log.Println("error in receive loop from:", s.Conn().RemotePeer(), "err:", err)
-		os.Exit(1)
+		log.Println("error in send loop to:", s.Conn().RemotePeer(), "err:", err)
+		n.lk.Lock()
+		n.disconnect(p, err)
+		n.lk.Unlock()
 	}
 }
 
 func (n *Netcode) handleStreamAsServer(s network.Stream) (err error) {
+	if !n.netsim.IsZero() {
+		s = netsim.Wrap(s, n.netsim, n.clock)
+	}
 	defer s.Reset()
 
+	theirs, role, password, err := n.readHello(s)
+	if err != nil {
+		return err
+	}
+	if err := n.versionOn(s.Protocol()).compatible(theirs); err != nil {
+		return n.reject(s, err.Error())
+	}
+
 	n.lk.Lock()
+	if n.closing {
+		n.lk.Unlock()
+		return n.reject(s, errHostLeft.Error())
+	}
+	remote := s.Conn().RemotePeer()
+	if reason := n.admit(remote, password); reason != "" {
+		n.lk.Unlock()
+		return n.reject(s, reason)
+	}
+	id, ok := n.identities[remote]
+	if ok {
+		if old, ok := n.players[id]; ok {
+			// it probably noticed the connection died before we did.
+			n.disconnect(old, fmt.Errorf("replaced by a new stream"))
+		}
+	} else {
+		id = n.totalPlayers
+		n.totalPlayers++
+		n.identities[remote] = id
+	}
+
 	// First: send our commited state.
 	// Note: we can't send Live because other players might rollback before it. So they need to maintain their own rollback buffer.
-	firstPacket := n.rollback.Commit.AppendMarshalBinary(nil)
+	firstPacket := n.versionOn(s.Protocol()).append(nil)
+	firstPacket = append(firstPacket, 0) // they are admitted
+	firstPacket = n.rollback.Commit.AppendMarshalBinary(firstPacket)
 
 	// Second: save all the reliable packets for them to catch-up.
 	var catchup []byte
@@ -283,39 +897,44 @@ func (n *Netcode) handleStreamAsServer(s network.Stream) (err error) {
 			continue // The other player would thought theses are reliable if we send them here.
 		}
 		catchup = binary.LittleEndian.AppendUint32(catchup, uint32(c.HappendAt))
+		catchup = binary.LittleEndian.AppendUint32(catchup, c.Player)
 		catchup = append(catchup, c.Op.Bytes()...)
 	}
+	catchup = n.appendRoster(catchup)
+	catchup = n.appendChatHistory(catchup)
 
 	// we will need to sync them future packets.
 	n.playersWaitingOnSend++
-	lastSentGen := n.lastSentGen()
-	playerId := n.totalPlayers
-	n.totalPlayers++
-
-	remoteNow := n.rollback.Live.Now
-	remoteNow++                                         // it will be allowed to send us inputs on the next tick.
-	idx := n.grabIdxInCommitWaitingOnPlayers(remoteNow) // make sure all up to this point already exists
-	n.playersBlockingCommits++
-	for i := idx; i < uint(len(n.commitWaitingOnPlayers)); i++ {
-		// block us on future ticks
-		n.commitWaitingOnPlayers[i]++
+	now := n.clock.Now()
+	p := &player{
+		id:          id,
+		s:           s,
+		lastSentGen: n.lastSentGen(),
+		remoteNow:   n.rollback.Live.Now + 1, // it will be allowed to send us inputs on the next tick.
+		lastRead:    now,                     // the handshake must complete within the read timeout since lastRead is only updated by the read loop.
+		lastWrite:   now,
+		spectator:   role == roleSpectator,
+		recvDone:    make(chan struct{}),
 	}
-	n.lk.Unlock()
-	var readWasStarted bool
-	cleanupPlayerReadEdge := func() {
-		// player disconnected, cleanup read edge
-		n.lk.Lock()
-		defer n.lk.Unlock()
-
-		n.playersBlockingCommits--
-		for i := n.calcIdxInCommitWaitingOnPlayers(remoteNow); i < uint(len(n.commitWaitingOnPlayers)); i++ {
-			// stop blocking yet to be commited ticks
-			n.commitWaitingOnPlayers[i].decrement()
+	n.players[p.id] = p
+	started := n.started
+	if p.spectator {
+		p.readEdgeCleaned = true // it never blocks commits
+	} else {
+		n.rosterJoin(p.id) // after p was added to the send queue so it learns about itself there.
+		if n.recorder != nil {
+			n.recorder.PlayerJoined(replay.Player{ID: p.id, Peer: remote.String()})
 		}
-		if n.cleanupCommits() {
-			n.sendCond.Broadcast()
+
+		idx := n.grabIdxInCommitWaitingOnPlayers(p.remoteNow) // make sure all up to this point already exists
+		n.playersBlockingCommits++
+		for i := idx; i < uint(len(n.commitWaitingOnPlayers)); i++ {
+			// block us on future ticks
+			n.commitWaitingOnPlayers[i]++
 		}
 	}
+	remoteNow := p.remoteNow
+	n.lk.Unlock()
 
 	defer func() {
 		if err == nil {
@@ -323,33 +942,20 @@ func (n *Netcode) handleStreamAsServer(s network.Stream) (err error) {
 			return
 		}
 
-		if !readWasStarted {
-			cleanupPlayerReadEdge()
-		}
-
-		// player disconnected, cleanup write edge
 		n.lk.Lock()
 		defer n.lk.Unlock()
-
-		n.playersWaitingOnSend--
-		for i := lastSentGen - n.sendGen; i < uint64(len(n.send)); i++ {
-			// stop blocking yet to be sent packets
-			n.send[i].decrementStillBlockedOnSend()
-		}
-		n.cleanupSends()
+		n.disconnect(p, err)
 	}()
 
-	// FIXME: s.SetWriteDeadline
-
 	if _, err := s.Write(firstPacket); err != nil {
 		return err
 	}
 
-	p := firstPacket[:0]
+	b := firstPacket[:0]
 
 	// Let the client figure out the timing
-	p = append(p[:0], 0, 0) // at least two bytes to error if the client doesn't us precisely one byte.
-	red, err := s.Read(p)
+	b = append(b[:0], 0, 0) // at least two bytes to error if the client doesn't us precisely one byte.
+	red, err := s.Read(b)
 	if err != nil {
 		return err
 	}
@@ -357,9 +963,15 @@ func (n *Netcode) handleStreamAsServer(s network.Stream) (err error) {
 		return fmt.Errorf("expected 1 for timing purposes, got %d", red)
 	}
 
-	p = binary.LittleEndian.AppendUint32(p[:0], uint32(remoteNow))
+	b = binary.LittleEndian.AppendUint32(b[:0], uint32(remoteNow))
+	b = binary.LittleEndian.AppendUint32(b, p.id)
+	if started {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
 
-	if _, err := s.Write(p); err != nil {
+	if _, err := s.Write(b); err != nil {
 		return err
 	}
 
@@ -370,46 +982,137 @@ func (n *Netcode) handleStreamAsServer(s network.Stream) (err error) {
 		}
 	}
 
-	readWasStarted = true
-
 	// Now start the main loops.
-	go func() {
-		if err := func() (err error) {
-			defer s.Reset()
-			defer func() {
-				if err != nil {
-					// avoid deadlock in case of panic
-					cleanupPlayerReadEdge()
-				}
-			}()
-
-			var buf rpcgame.Command
-			for {
-				// FIXME: s.SetReadDeadline
-				_, err := io.ReadFull(s, buf[:2])
-				if err != nil {
-					return fmt.Errorf("reading opcode: %w", err)
-				}
-				op := rpcgame.OpCode(binary.LittleEndian.Uint16(buf[:]))
-				sz, ok := op.Size()
-				if !ok {
-					return fmt.Errorf("sent us invalid opcode: %v", op)
-				}
-				if sz > 2 {
-					_, err = io.ReadFull(s, buf[2:sz])
-					if err != nil {
-						return fmt.Errorf("reading payload %v: %w", op, err)
-					}
-				}
+	n.lk.Lock()
+	running := n.spawn(func() {
+		defer close(p.recvDone)
+		if err := n.serverRecv(p, bufio.NewReader(s)); err != nil {
+			log.Println("error in receive loop from:", s.Conn().RemotePeer(), "err:", err)
+			n.lk.Lock()
+			n.disconnect(p, err)
+			n.lk.Unlock()
+		}
+	})
+	n.lk.Unlock()
+	if !running {
+		return errClosed
+	}
 
-				// FIXME: we can optimize this, instead of handling packet by packet we can batch with bufio.Reader and r.Buffered(), would create less sync events after Head-Of-Line event.
-				// FIXME: use RPC namespaces in to sanitize allowed RPC calls.
+	var reuse []byte // not reusing first packet since it's very likely way bigger than we ever need again, maybe it's fine to do so.
+	// Then listen for new packets to send and forward them.
+	for {
+		n.lk.Lock()
+		n.wrote(p)
+		for n.lastSentGen() == p.lastSentGen && p.err == nil && !p.metaDue() {
+			n.sendCond.Wait()
+		}
+		if err := p.err; err != nil {
+			var b []byte
+			if p.farewell != nil {
+				b = binary.LittleEndian.AppendUint32(b, uint32(n.rollback.Commit.Now))
+				b = binary.LittleEndian.AppendUint32(b, 0)
+				b = append(b, p.farewell.Bytes()...)
+			}
+			n.lk.Unlock()
+			sayFarewell(s, p, b)
+			return err
+		}
+		b := reuse[:0]
+		for i := p.lastSentGen - n.sendGen; i < uint64(len(n.send)); i++ {
+			n.send[i].decrementStillBlockedOnSend()
+			todo := n.send[i]
+			if todo.fromPlayerId == p.id {
+				p.ownPending--
+				continue // don't loop back their own packets
+			}
+
+			b = binary.LittleEndian.AppendUint32(b, uint32(todo.when))
+			b = binary.LittleEndian.AppendUint32(b, todo.fromPlayerId)
+			b = append(b, todo.cmd.Bytes()...)
+			b = append(b, todo.payload...)
+		}
+		n.cleanupSends()
+		p.lastSentGen = n.lastSentGen()
+		b = n.beginWrite(p, b)
+		n.lk.Unlock()
+
+		if len(b) == 0 {
+			// don't bother trying to write if none of the packet were sendable.
+			// For example, let's say this player sent a reliable packet and this was the only packet we got woken up for, we wont send them anything else.
+		} else {
+			if _, err := s.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// serverRecv reads commands from p until an error happens.
+// Like [Netcode.clientRecv] everything already buffered is handled under a single lock.
+func (n *Netcode) serverRecv(p *player, r *bufio.Reader) error {
+	ns := rpcgame.ClientToServer
+	if p.spectator {
+		ns = rpcgame.SpectatorToServer
+	}
+	var batch []timedCommand // only cmd and payload are used, the time is implied by CommitTick
+	var pending []rollback.Command
+	for {
+		batch = batch[:0]
+		var readErr error
+		for len(batch) == 0 || (len(batch) < maxRecvBatch && commandBuffered(r, 0)) {
+			var c timedCommand
+			if err := ns.Read(r, &c.cmd); err != nil {
+				readErr = err
+				break
+			}
+			var err error
+			if c.payload, err = rpcgame.ReadPayload(r, &c.cmd); err != nil {
+				readErr = err
+				break
+			}
+			batch = append(batch, c)
+		}
+		if len(batch) == 0 {
+			return readErr
+		}
 
-				n.lk.Lock()
-				switch op {
+		n.lk.Lock()
+		if p.err != nil {
+			n.lk.Unlock()
+			return p.err
+		}
+		now := n.clock.Now()
+		p.lastRead = now
+		n.recvBatches++
+		n.recvCommands += uint64(len(batch))
+		if err := func() error {
+			// what was accepted before an error must still be applied, it is already relayed to the others.
+			defer func() { pending = n.applyBatch(pending) }()
+			for _, c := range batch {
+				buf := c.cmd
+				switch buf.OpCode() {
+				case rpcgame.ClientHeartbeat:
+				case rpcgame.ClientPing:
+					n.gotPing(p, binary.LittleEndian.Uint32(buf[2:]))
+				case rpcgame.ClientPong:
+					n.gotPong(p, binary.LittleEndian.Uint32(buf[2:]), now)
+				case rpcgame.Leave:
+					return errLeft
+				case rpcgame.SetName, rpcgame.SetReady:
+					if err := n.gotRosterCommand(p, buf, c.payload); err != nil {
+						return err
+					}
+				case rpcgame.Chat:
+					if err := n.gotChat(p, buf, c.payload, now); err != nil {
+						return err
+					}
 				case rpcgame.CommitTick:
-					commitedTick := remoteNow
-					remoteNow++
+					if p.remoteNow >= n.rollback.Live.Now+n.maxCommitLag {
+						return fmt.Errorf("running more than %d ticks ahead of us", n.maxCommitLag)
+					}
+					pending = n.applyBatch(pending) // the commands of this tick must be in before it can be commited.
+					commitedTick := p.remoteNow
+					p.remoteNow++
 
 					idx := n.grabIdxInCommitWaitingOnPlayers(commitedTick)
 					n.commitWaitingOnPlayers[idx].decrement()
@@ -417,52 +1120,283 @@ func (n *Netcode) handleStreamAsServer(s network.Stream) (err error) {
 						n.sendCond.Broadcast()
 					}
 				default:
-					// FIXME: optimization, .Do could tell us if this command was dup along of telling us if live is new, if it's dupped (and the previous one is not unreliable) we don't need to send this.
-					if n.rollback.Do(rollback.Command{Op: buf, Reliable: true, HappendAt: remoteNow}) {
-						n.stateCond.Broadcast()
+					if err := n.rollback.Live.Validate(p.remoteNow, p.id, buf); err != nil {
+						if !errors.Is(err, state.ErrNotOwner) {
+							return fmt.Errorf("invalid command: %w", err)
+						}
+						if !n.ownershipPending(p.remoteNow) {
+							continue // dropped, it would be ignored by everyone anyway.
+						}
 					}
-					if n.pushSent(playerId, remoteNow, buf) {
+					clampPause(&buf, p.remoteNow)
+					switch buf.OpCode() {
+					case rpcgame.Pause:
+						if at := state.Time(binary.LittleEndian.Uint32(buf[2:])); at < n.rollback.Live.Now {
+							return fmt.Errorf("pause at %d arrived after we reached %d", at, n.rollback.Live.Now)
+						}
+					case rpcgame.Resume:
+						n.scheduleResume(buf, now)
+					}
+					// FIXME: optimization, .Do could tell us if this command was dup along of telling us if live is new, if it's dupped (and the previous one is not unreliable) we don't need to send this.
+					// the id is ours to stamp, clients can't claim to be someone else.
+					pending = append(pending, rollback.Command{Op: buf, Player: p.id, Reliable: true, HappendAt: p.remoteNow})
+					if n.pushSent(p.id, p.remoteNow, buf) {
 						n.sendCond.Broadcast()
 					}
 				}
-				n.lk.Unlock()
 			}
+			return nil
 		}(); err != nil {
-			log.Println("error in receive loop from:", s.Conn().RemotePeer(), "err:", err)
+			n.lk.Unlock()
+			return err
 		}
-	}()
+		n.enforceLimits()
+		n.lk.Unlock()
 
-	var reuse []byte // not reusing first packet since it's very likely way bigger than we ever need again, maybe it's fine to do so.
-	// Then listen for new packets to send and forward them.
-	for {
-		n.lk.Lock()
-		for n.lastSentGen() == lastSentGen {
-			n.sendCond.Wait()
+		if readErr != nil {
+			return readErr
 		}
-		p := reuse[:0]
-		for i := lastSentGen - n.sendGen; i < uint64(len(n.send)); i++ {
-			n.send[i].decrementStillBlockedOnSend()
-			todo := n.send[i]
-			if todo.fromPlayerId == playerId {
-				continue // don't loop back their own packets
-			}
+	}
+}
+
+// disconnect kicks p out and stop it from blocking commits and sends.
+// On the client p is the server and we start reconnecting.
+// It is idempotent, only the first error is kept.
+// Must be called holding [n.lk].
+func (n *Netcode) disconnect(p *player, err error) {
+	if p.err != nil {
+		return
+	}
+	p.err = err
+	if p.farewell != nil {
+		// the write loop tells it before resetting the stream, unless it is stuck writing.
+		n.clock.AfterFunc(farewellGrace, func() { p.s.Reset() })
+	} else {
+		go p.s.Reset() // unblock the read and write loops, Reset might block on IO so don't do it while holding the lock.
+	}
+
+	if n.target == "" {
+		n.cleanupPlayerReadEdge(p)
+	}
+	n.cleanupPlayerWriteEdge(p)
+	if n.target == "" {
+		n.rosterLeave(p.id)
+	}
+	n.sendCond.Broadcast() // wake up p's write loop so it sees p.err
+
+	if n.target != "" && !n.kicked {
+		n.spawn(n.reconnect)
+	}
+}
+
+// cleanupPlayerReadEdge stops p from blocking yet to be commited ticks.
+// Must be called holding [n.lk].
+func (n *Netcode) cleanupPlayerReadEdge(p *player) {
+	if p.readEdgeCleaned {
+		return
+	}
+	p.readEdgeCleaned = true
+
+	n.playersBlockingCommits--
+	for i := n.calcIdxInCommitWaitingOnPlayers(p.remoteNow); i < uint(len(n.commitWaitingOnPlayers)); i++ {
+		// stop blocking yet to be commited ticks
+		n.commitWaitingOnPlayers[i].decrement()
+	}
+	if n.cleanupCommits() {
+		n.sendCond.Broadcast()
+	}
+}
 
-			p = binary.LittleEndian.AppendUint32(p, uint32(todo.when))
-			p = append(p, todo.cmd.Bytes()...)
+// cleanupPlayerWriteEdge stops p from blocking yet to be sent packets.
+// Must be called holding [n.lk].
+func (n *Netcode) cleanupPlayerWriteEdge(p *player) {
+	if p.writeEdgeCleaned {
+		return
+	}
+	p.writeEdgeCleaned = true
+
+	n.playersWaitingOnSend--
+	if n.target == "" {
+		delete(n.players, p.id)
+		if n.recorder != nil && !p.spectator {
+			n.recorder.PlayerLeft(p.id)
 		}
-		n.cleanupSends()
-		lastSentGen = n.lastSentGen()
-		n.lk.Unlock()
+	}
+	for i := p.lastSentGen - n.sendGen; i < uint64(len(n.send)); i++ {
+		// stop blocking yet to be sent packets
+		n.send[i].decrementStillBlockedOnSend()
+	}
+	n.cleanupSends()
+}
 
-		if len(p) == 0 {
-			// don't bother trying to write if none of the packet were sendable.
-			// For example, let's say this player sent a reliable packet and this was the only packet we got woken up for, we wont send them anything else.
-		} else {
-			// FIXME: s.SetWriteDeadline
+// enforceLimits disconnects the players making our queues grow past their limits.
+// Must be called holding [n.lk] and not while iterating queues since disconnecting players modifies them.
+func (n *Netcode) enforceLimits() {
+	if uint64(len(n.send)) > n.maxSendBacklog { // the backlog of any player is at most len(n.send), don't bother iterating them otherwise
+		for p := range n.remotes {
+			if backlog := n.sendBacklog(p); backlog > n.maxSendBacklog {
+				n.disconnect(p, fmt.Errorf("send backlog of %d packets is too big", backlog))
+			}
+		}
+	}
 
-			if _, err := s.Write(p); err != nil {
-				return err
+	if lag := n.rollback.Live.Now - n.rollback.Commit.Now; lag > n.maxCommitLag {
+		if n.target == "" {
+			for _, p := range n.players {
+				if !p.spectator && p.remoteNow <= n.rollback.Commit.Now+1 {
+					n.disconnect(p, fmt.Errorf("blocked commits for %d ticks", lag))
+				}
 			}
+		} else {
+			n.disconnect(n.server, fmt.Errorf("server did not commit for %d ticks", lag))
+		}
+	}
+}
+
+// enforceTimeouts disconnects the peers we did not hear from or which are stuck on a write for too long, and schedules heartbeats to the idle ones and pings.
+// Must be called holding [n.lk].
+func (n *Netcode) enforceTimeouts(now time.Time) {
+	var needsToBroadcastSend bool
+	for p := range n.remotes {
+		switch {
+		case n.readTimeout != 0 && now.Sub(p.lastRead) > n.readTimeout:
+			n.disconnect(p, fmt.Errorf("nothing received for %v", now.Sub(p.lastRead)))
+		case n.writeTimeout != 0 && p.writing && now.Sub(p.lastWrite) > n.writeTimeout:
+			n.disconnect(p, fmt.Errorf("write blocked for %v", now.Sub(p.lastWrite)))
+		case n.heartbeatInterval != 0 && !p.heartbeatDue && now.Sub(p.lastWrite) >= n.heartbeatInterval:
+			p.heartbeatDue = true
+			needsToBroadcastSend = true
+		}
+		if p.err == nil && n.pingInterval != 0 && !p.pingDue && !p.pingInFlight && now.Sub(p.pingSentAt) >= n.pingInterval {
+			p.pingDue = true
+			needsToBroadcastSend = true
+		}
+		if p.err == nil && n.target == "" && n.started && !n.rollback.Live.Frozen() && n.clockSyncInterval != 0 && !p.liveTickDue && now.Sub(p.liveTickSentAt) >= n.clockSyncInterval {
+			p.liveTickDue = true
+			needsToBroadcastSend = true
+		}
+	}
+	if needsToBroadcastSend {
+		n.sendCond.Broadcast()
+	}
+}
+
+// metaDue returns true if the write loop has something to send to p which isn't in the send queue.
+// Must be called holding [Netcode.lk].
+func (p *player) metaDue() bool {
+	return p.heartbeatDue || p.pingDue || p.pongDue || p.leadDue || p.liveTickDue || p.rosterDue
+}
+
+// beginWrite is called by the write loops with the bytes about to be written to p.
+// It adds the meta packets due, and a heartbeat if there is nothing else to send.
+// Must be called holding [n.lk].
+func (n *Netcode) beginWrite(p *player, b []byte) []byte {
+	now := n.clock.Now()
+	heartbeat, ping, pong := rpcgame.EncodeClientHeartbeat, rpcgame.EncodeClientPing, rpcgame.EncodeClientPong
+	if n.target == "" {
+		heartbeat, ping, pong = rpcgame.EncodeServerHeartbeat, rpcgame.EncodeServerPing, rpcgame.EncodeServerPong
+	}
+	meta := func(c rpcgame.Command) {
+		if n.target == "" {
+			// the client ignores them but server to client packets always carry a time and a player, meta ones are from us.
+			b = binary.LittleEndian.AppendUint32(b, uint32(n.rollback.Commit.Now))
+			b = binary.LittleEndian.AppendUint32(b, 0)
+		}
+		b = append(b, c.Bytes()...)
+	}
+	if p.pongDue {
+		p.pongDue = false
+		meta(pong(p.pongSeq))
+	}
+	if p.pingDue {
+		p.pingDue = false
+		p.pingInFlight = true
+		p.pingSeq++
+		p.pingSentAt = now
+		meta(ping(p.pingSeq))
+	}
+	if p.leadDue {
+		p.leadDue = false
+		meta(rpcgame.EncodeLead(uint32(p.lead)))
+	}
+	if p.liveTickDue {
+		p.liveTickDue = false
+		p.liveTickSentAt = now
+		meta(rpcgame.EncodeLiveTick(uint32(n.rollback.Live.Now)))
+	}
+	if p.rosterDue {
+		p.rosterDue = false
+		meta(rpcgame.EncodeSetName(n.name))
+		b = append(b, n.name...)
+		meta(rpcgame.EncodeSetReady(n.ready))
+	}
+	if p.heartbeatDue && len(b) == 0 {
+		meta(heartbeat())
+	}
+	p.heartbeatDue = false
+	if len(b) != 0 {
+		p.writing = true
+		p.lastWrite = now
+	}
+	return b
+}
+
+// gotPing schedules an answer to p's ping.
+// Must be called holding [n.lk].
+func (n *Netcode) gotPing(p *player, seq uint32) {
+	p.pongSeq = seq
+	p.pongDue = true
+	n.sendCond.Broadcast()
+}
+
+// gotPong updates p's round trip time and on the server the lead we ask it to run at.
+// Must be called holding [n.lk].
+func (n *Netcode) gotPong(p *player, seq uint32, now time.Time) {
+	if !p.pingInFlight || seq != p.pingSeq {
+		return
+	}
+	p.pingInFlight = false
+	p.rtt.sample(now.Sub(p.pingSentAt))
+	if n.target == "" {
+		if lead := p.rtt.lead(); lead != p.lead {
+			p.lead = lead
+			p.leadDue = true
+			n.sendCond.Broadcast()
+		}
+	}
+}
+
+// gotLiveTick compares where our live is with where the server wants it, serverLive plus the one way latency and our lead.
+// The tick loop picks up the corrected period on it's next tick.
+// Must be called holding [n.lk].
+func (n *Netcode) gotLiveTick(p *player, serverLive state.Time, now time.Time) {
+	if p.rtt.samples == 0 || n.lastTickAt.IsZero() || n.rollback.Live.Frozen() {
+		return // we can't tell how old it is or where we are yet, or we are paused
+	}
+	ours := float64(n.rollback.Live.Now) + float64(now.Sub(n.lastTickAt))/float64(n.tickPeriod)
+	// The server was somewhere inside serverLive when it sent it, assume the middle.
+	target := float64(serverLive) + .5 + float64(p.rtt.srtt/2)/float64(waitPerTick) + float64(p.lead)
+	n.drift.sample(ours, target)
+}
+
+// sendBacklog returns how many packets are waiting to be sent to p.
+// Must be called holding [n.lk].
+func (n *Netcode) sendBacklog(p *player) uint64 {
+	return n.lastSentGen() - p.lastSentGen - p.ownPending
+}
+
+// remotes iterates the peers we are connected to, on the server all players, on the client the server.
+// Must be called holding [n.lk].
+func (n *Netcode) remotes(yield func(*player) bool) {
+	if n.target != "" {
+		if n.server != nil {
+			yield(n.server)
+		}
+		return
+	}
+	for _, p := range n.players {
+		if !yield(p) {
+			return
 		}
 	}
 }
@@ -536,6 +1470,17 @@ func (n *Netcode) cleanupCommits() (needToBroadcastSend bool) {
 // if needsToBroadcastSent == true the caller must call n.sendCond.Broadcast afterwards.
 func (n *Netcode) tickCommit() (needsToBroadcastSent bool) {
 	oldTick := n.rollback.Commit.Now
+	if n.recorder != nil {
+		for c := range n.rollback.Joins {
+			if c.HappendAt != oldTick {
+				break
+			}
+			if c.Reliable {
+				n.recorder.Command(c.Player, c.Op)
+			}
+		}
+		n.recorder.Tick()
+	}
 	n.rollback.TickCommit()
 	return n.pushSent(0, oldTick, rpcgame.EncodeCommitTick()) // FIXME: should we change wire to not change tick id for meta stuff ?
 }
@@ -544,6 +1489,12 @@ func (n *Netcode) tickCommit() (needsToBroadcastSent bool) {
 // Must be called holding [n.lk].
 // if needsToBroadcastSend == true the caller must call n.sendCond.Broadcast afterwards.
 func (n *Netcode) pushSent(fromPlayerId uint32, when state.Time, cmd rpcgame.Command) (needsToBroadcastSend bool) {
+	return n.pushSentPayload(fromPlayerId, when, cmd, nil)
+}
+
+// pushSentPayload is [Netcode.pushSent] for variably sized commands, payload must not be modified afterwards.
+// Must be called holding [n.lk].
+func (n *Netcode) pushSentPayload(fromPlayerId uint32, when state.Time, cmd rpcgame.Command, payload []byte) (needsToBroadcastSend bool) {
 	if n.playersWaitingOnSend == 0 {
 		return false
 	}
@@ -551,7 +1502,10 @@ func (n *Netcode) pushSent(fromPlayerId uint32, when state.Time, cmd rpcgame.Com
 		panic("client is trying to send packets out of order")
 	}
 
-	n.send = append(n.send, sent{fromPlayerId, n.playersWaitingOnSend, when, cmd})
+	n.send = append(n.send, sent{fromPlayerId, n.playersWaitingOnSend, when, cmd, payload})
+	if p, ok := n.players[fromPlayerId]; ok {
+		p.ownPending++
+	}
 	return true
 }
 
@@ -559,43 +1513,123 @@ func (n *Netcode) renderLoop() {
 	var lastRendered uint64
 	for {
 		n.lk.Lock()
-		for n.rollback.LiveGen == lastRendered {
+		for (n.rollback.LiveGen == lastRendered || !n.started) && len(n.mispredicted) == 0 && len(n.reconnecting) == 0 && len(n.rosterEvents) == 0 && len(n.chatEvents) == 0 && n.disconnected == nil && !n.closing {
 			n.stateCond.Wait()
 		}
-		lastRendered = n.rollback.LiveGen
-		n.render(&n.rollback.Live, n.lk.Unlock)
+		closing := n.closing
+		mispredicted := n.mispredicted
+		n.mispredicted = nil
+		reconnecting := n.reconnecting
+		n.reconnecting = nil
+		rosterEvents := n.rosterEvents
+		n.rosterEvents = nil
+		chatEvents := n.chatEvents
+		n.chatEvents = nil
+		disconnected := n.disconnected
+		n.disconnected = nil
+		if n.rollback.LiveGen != lastRendered && n.started {
+			lastRendered = n.rollback.LiveGen
+			n.frontend.Render(&n.rollback.Live, n.lk.Unlock)
+		} else {
+			n.lk.Unlock()
+		}
+
+		for _, c := range mispredicted {
+			n.frontend.Mispredicted(c)
+		}
+		for _, a := range reconnecting {
+			n.frontend.Reconnecting(a)
+		}
+		for _, e := range rosterEvents {
+			n.frontend.Roster(e.c, e.name)
+		}
+		for _, m := range chatEvents {
+			n.frontend.Chat(m.player, m.callout, m.text)
+		}
+		if disconnected != nil {
+			n.frontend.Disconnected(*disconnected)
+		}
+		if closing {
+			return
+		}
+	}
+}
+
+// recordLoop periodically flushes the replay to disk, this avoid doing IO while holding [n.lk].
+// [Netcode.Close] flushes the rest.
+func (n *Netcode) recordLoop() {
+	const flushEvery = time.Second
+	for {
+		n.lk.Lock()
+		b := n.recorder.Take()
+		n.lk.Unlock()
+
+		if _, err := n.recordTo.Write(b); err != nil {
+			log.Println("error writing replay, stopping recording:", err)
+			n.lk.Lock()
+			n.recorder = nil
+			n.lk.Unlock()
+			return
+		}
+		if !n.sleep(flushEvery) {
+			return
+		}
 	}
 }
 
+// startRenderLoop starts the client's render loop the first time it is called, it keeps running across reconnections.
+func (n *Netcode) startRenderLoop() {
+	n.renderLoopOnce.Do(func() {
+		n.lk.Lock()
+		defer n.lk.Unlock()
+		n.spawn(n.renderLoop)
+	})
+}
+
 // start needs to have a monotonic component.
 // for the client we need to wait until sendAfter to confirm (before we catchup).
-func (n *Netcode) tickLoop(start time.Time, sendAfter state.Time) {
-	const waitPerTick = time.Second / state.TickRate
+// server is nil on the server, on the client the loop stops once it is disconnected, the next session starts a new one.
+func (n *Netcode) tickLoop(start time.Time, sendAfter state.Time, server *player) {
+	start, ok := n.waitInLobby(start, server)
+	if !ok {
+		return
+	}
+	period := waitPerTick // the client nudges it to correct clock drift
 	var startedRenderLoop bool
 	for {
 		// Use a custom ticker to make sure we never get many ticks out of sync.
 		// If time.Sleep is so slow we missed let's say 2 ticks, then we tick twice.
-		dt := time.Since(start)
-		todo := dt / waitPerTick
+		dt := n.clock.Now().Sub(start)
+		todo := dt / period
 		if todo == 0 {
-			time.Sleep(waitPerTick - dt)
+			n.clock.Sleep(period - dt)
 			if !startedRenderLoop && n.target != "" {
 				// wait to be caught up to start the client renderloop other wise we messup all of zig's attempt to time us properly.
 				startedRenderLoop = true
-				go n.renderLoop()
+				n.startRenderLoop()
 			}
 			continue // retry check timing once it should be big enough
 		} else {
-			start = start.Add(todo * waitPerTick) // jump forward
+			start = start.Add(todo * period) // jump forward
 		}
 
 		n.lk.Lock()
+		if server != nil && server.err != nil || n.closing {
+			n.lk.Unlock()
+			return
+		}
 		var needsToBroadcastSend bool
 		for range todo {
+			if n.rollback.Live.Frozen() {
+				break // the rest is dropped, waitWhilePaused restarts from where we stopped.
+			}
 			n.rollback.TickLive()
+			if server != nil {
+				period = n.drift.next()
+			}
 			if n.target != "" {
 				// client
-				if n.rollback.Live.Now >= sendAfter {
+				if n.rollback.Live.Now >= sendAfter && !n.spectator {
 					needsToBroadcastSend = n.pushSent(0, n.rollback.Live.Now, rpcgame.EncodeCommitTick())
 				}
 			}
@@ -607,26 +1641,146 @@ func (n *Netcode) tickLoop(start time.Time, sendAfter state.Time) {
 		if needsToBroadcastSend {
 			n.sendCond.Broadcast()
 		}
+		if server != nil {
+			n.lastTickAt = start
+			n.tickPeriod = period
+		}
+		paused := n.rollback.Live.Frozen()
+		if paused {
+			n.resumeAt = time.Time{} // set by the Resume unfreezing us
+			n.lastTickAt = time.Time{}
+		}
+		n.enforceLimits()
+		n.enforceTimeouts(n.clock.Now())
 		n.stateCond.Broadcast()
 		n.lk.Unlock()
 
+		if paused {
+			if start, ok = n.waitWhilePaused(server); !ok {
+				return
+			}
+		}
 	}
 }
 
 // Act is from our own POV, it's our player doing something.
 // It will update live be timestamped and synced with other players.
+// It is ignored while waiting in the lobby and when spectating.
 func (n *Netcode) Act(cmd rpcgame.Command) {
 	n.lk.Lock()
-	defer n.lk.Unlock()
-
+	if !n.started || n.spectator {
+		n.lk.Unlock()
+		return
+	}
 	now := n.rollback.Live.Now
-	if liveIsNew := n.rollback.Do(rollback.Command{Op: cmd, Reliable: true, HappendAt: now}); liveIsNew {
+	if cmd.OpCode() == rpcgame.Resume {
+		serverGetsItAt := n.clock.Now()
+		if n.server != nil {
+			serverGetsItAt = serverGetsItAt.Add(n.server.rtt.srtt / 2)
+		}
+		n.scheduleResume(cmd, serverGetsItAt)
+	}
+	if liveIsNew := n.rollback.Do(rollback.Command{Op: cmd, Player: n.id, Reliable: true, HappendAt: now}); liveIsNew {
 		n.stateCond.Broadcast()
 	}
 
 	if n.pushSent(0, now, cmd) {
 		n.sendCond.Broadcast()
 	}
+	n.enforceLimits()
+	id := n.id
+	n.lk.Unlock()
+
+	if n.mesh != nil && rpcgame.Mesh.Allows(cmd.OpCode()) {
+		n.mesh.Send(now, id, cmd)
+	}
+}
+
+// Stats are instrumentation values about the netcode.
+type Stats struct {
+	Rollback rollback.Stats
+
+	Mesh mesh.Stats // client only
+
+	SendQueue uint64 // packets waiting to be sent to at least one peer
+	// ReceivedCommands counts commands read from peers, meta ones included.
+	// ReceiveBatches counts how many times the receive loops took the lock to handle them, it is lower when bursts are batched.
+	ReceivedCommands uint64
+	ReceiveBatches   uint64
+	CommitQueue      uint64 // ticks tracked waiting on players before they can be commited, server only
+	ChatDropped      uint64 // chat messages dropped by the rate limit, server only
+	Remotes          []RemoteStats
+}
+
+type RemoteStats struct {
+	ID          uint32
+	Peer        peer.ID
+	Spectator   bool       // server only
+	SendBacklog uint64     // packets waiting to be sent to this peer
+	RemoteNow   state.Time // server only, the next tick this player will send inputs for
+
+	RTT    time.Duration // smoothed round trip time
+	Jitter time.Duration // smoothed round trip time variation
+	Lead   state.Time    // how many ticks ahead of the server the client should run
+
+	ClockOffset float64       // client only, smoothed ticks our live is ahead of where the server wants it
+	TickPeriod  time.Duration // client only, the period our tick loop currently runs at
+}
+
+func (n *Netcode) Stats() Stats {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	s := Stats{
+		Rollback:         n.rollback.Stats(),
+		SendQueue:        uint64(len(n.send)),
+		ReceivedCommands: n.recvCommands,
+		ReceiveBatches:   n.recvBatches,
+		CommitQueue:      uint64(len(n.commitWaitingOnPlayers)),
+		ChatDropped:      n.chatDropped,
+	}
+	if n.mesh != nil {
+		s.Mesh = n.mesh.Stats()
+	}
+	for p := range n.remotes {
+		s.Remotes = append(s.Remotes, RemoteStats{
+			ID:          p.id,
+			Peer:        p.s.Conn().RemotePeer(),
+			Spectator:   p.spectator,
+			SendBacklog: n.sendBacklog(p),
+			RemoteNow:   p.remoteNow,
+			RTT:         p.rtt.srtt,
+			Jitter:      p.rtt.rttvar,
+			Lead:        p.lead,
+			ClockOffset: n.drift.offset,
+			TickPeriod:  n.tickPeriod,
+		})
+	}
+	return s
+}
+
+// maxUnreliableLead bounds how far in the future of Live unreliable commands are accepted.
+// Without this a peer on the unreliable path could make us grow the rollback buffer forever.
+const maxUnreliableLead = state.TickRate
+
+// DoUnreliable inserts a command received from another player over an unreliable path.
+// It is applied optimistically to live, and discarded at commit (or past the unreliable horizon) unless the same command is received reliably.
+// Commands too old or too far in the future are ignored, as are the ones [rpcgame.Mesh] does not allow.
+func (n *Netcode) DoUnreliable(when state.Time, player uint32, cmd rpcgame.Command) {
+	if !rpcgame.Mesh.Allows(cmd.OpCode()) {
+		return // the frontend is only told about mispredictions it knows how to display
+	}
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	if when <= n.rollback.Commit.Now || when > n.rollback.Live.Now+maxUnreliableLead {
+		return
+	}
+	if n.rollback.Live.Validate(when, player, cmd) != nil {
+		return
+	}
+	if n.rollback.Do(rollback.Command{Op: cmd, Player: player, Reliable: false, HappendAt: when}) {
+		n.stateCond.Broadcast()
+	}
 }
 
 type playersBlockingCommits uint32
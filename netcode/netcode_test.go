@@ -0,0 +1,943 @@
+package netcode
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jorropo/OpenAirways/internal/manualclock"
+	"github.com/Jorropo/OpenAirways/mesh"
+	"github.com/Jorropo/OpenAirways/netsim"
+	"github.com/Jorropo/OpenAirways/replay"
+	"github.com/Jorropo/OpenAirways/rollback"
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+	"github.com/Jorropo/OpenAirways/state"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+type nopFrontend struct{}
+
+func (nopFrontend) Render(_ *state.State, release func()) { release() }
+func (nopFrontend) Mispredicted(rollback.Command)         {}
+func (nopFrontend) Reconnecting(uint32)                   {}
+func (nopFrontend) Roster(rpcgame.Command, string)        {}
+func (nopFrontend) Chat(uint32, uint8, []byte)            {}
+func (nopFrontend) Disconnected(rpcgame.Command)          {}
+
+// newMocknet returns a fully connected mocknet, hosts[0] is meant to be the server.
+func newMocknet(t *testing.T, n int) []host.Host {
+	t.Helper()
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	hosts := make([]host.Host, n)
+	for i := range hosts {
+		h, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts[i] = h
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+	return hosts
+}
+
+// rawClient does the client side of the handshake by hand so tests can misbehave.
+func rawClient(t *testing.T, h host.Host, server host.Host) network.Stream {
+	t.Helper()
+	return rawClientAs(t, h, server, rolePlayer)
+}
+
+func rawClientAs(t *testing.T, h host.Host, server host.Host, role byte) network.Stream {
+	t.Helper()
+	s, err := h.NewStream(context.Background(), server.ID(), Proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Reset() })
+	if _, err := s.Write(append(currentVersion.append(nil), role, 0)); err != nil { // no password
+		t.Fatal(err)
+	}
+	if _, err := readVersion(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := readAdmission(s); err != nil {
+		t.Fatal(err)
+	}
+	var st state.State
+	if _, err := st.Read(s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	var b [9]byte // remote now + our player id + started
+	if _, err := io.ReadFull(s, b[:]); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// sendCommitTicks sends CommitTick at the tick rate until the stream breaks.
+func sendCommitTicks(s network.Stream) {
+	tick := rpcgame.EncodeCommitTick()
+	for range time.Tick(time.Second / state.TickRate) {
+		if _, err := s.Write(tick.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// waitFor polls cond in real time until it is true and fails the test if it takes too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForRemotes waits for n to have count remotes, check is given every [Stats] seen in the meantime.
+func waitForRemotes(t *testing.T, n *Netcode, count int, check func(Stats)) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%d remotes", count), func() bool {
+		s := n.Stats()
+		check(s)
+		return len(s.Remotes) == count
+	})
+}
+
+func TestStalledReaderIsDisconnected(t *testing.T) {
+	const limit = 64
+	hosts := newMocknet(t, 3)
+	n, err := New(context.Background(), hosts[0], nopFrontend{}, "", MaxSendBacklog(limit), MaxCommitLag(state.TickRate*60))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stalled := rawClient(t, hosts[1], hosts[0])
+	go sendCommitTicks(stalled) // keep commits flowing, only the write edge is stalled
+
+	flooder := rawClient(t, hosts[2], hosts[0])
+	go io.Copy(io.Discard, flooder)
+	go sendCommitTicks(flooder)
+	go func() {
+		// send bursts of half the limit, the stalled reader should be disconnected on the third one.
+		var i uint32
+		for {
+			var b []byte
+			for range limit / 2 {
+				cmd := rpcgame.EncodeGivePlaneHeading(0, rpcgame.Rot16(i))
+				b = append(b, cmd.Bytes()...)
+				i++
+			}
+			if _, err := flooder.Write(b); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var maxQueue uint64
+	waitForRemotes(t, n, 1, func(s Stats) {
+		maxQueue = max(maxQueue, s.SendQueue)
+	})
+	// keep watching the queue while the flooder keeps going.
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		s := n.Stats()
+		maxQueue = max(maxQueue, s.SendQueue)
+		if len(s.Remotes) != 1 {
+			t.Fatalf("flooder got disconnected, remotes: %d", len(s.Remotes))
+		}
+	}
+	// the queue can hold the stalled backlog plus the flooder's burst which it didn't yet had a chance to skip.
+	if maxQueue > limit*2+1 {
+		t.Fatalf("send queue grew to %d, limit is %d", maxQueue, limit)
+	}
+
+	if _, err := io.Copy(io.Discard, stalled); err == nil {
+		t.Fatal("expected the stalled stream to be reset")
+	}
+}
+
+func TestCommitBlockerIsDisconnected(t *testing.T) {
+	const lag = 10
+	hosts := newMocknet(t, 2)
+	n, err := New(context.Background(), hosts[0], nopFrontend{}, "", MaxCommitLag(lag))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := rawClient(t, hosts[1], hosts[0])
+	go io.Copy(io.Discard, s) // reads fine, but never sends CommitTick
+
+	waitForRemotes(t, n, 0, func(s Stats) {
+		if s.Rollback.Distance > lag+1 {
+			t.Fatalf("live ran %d ticks ahead of commit, limit is %d", s.Rollback.Distance, lag)
+		}
+		if s.CommitQueue > lag+1 {
+			t.Fatalf("commit queue grew to %d, limit is %d", s.CommitQueue, lag)
+		}
+	})
+}
+
+func TestRunningAheadIsDisconnected(t *testing.T) {
+	const lag = 10
+	hosts := newMocknet(t, 2)
+	n, err := New(context.Background(), hosts[0], nopFrontend{}, "", MaxCommitLag(lag))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := rawClient(t, hosts[1], hosts[0])
+	go io.Copy(io.Discard, s)
+	tick := rpcgame.EncodeCommitTick()
+	var b []byte
+	for range lag * 10 {
+		b = append(b, tick.Bytes()...)
+	}
+	if _, err := s.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForRemotes(t, n, 0, func(s Stats) {
+		if s.Rollback.JoinLength > lag*2 {
+			t.Fatalf("join buffer grew to %d, limit is %d", s.Rollback.JoinLength, lag)
+		}
+	})
+}
+
+func TestSilentPeerIsDisconnected(t *testing.T) {
+	hosts := newMocknet(t, 2)
+	n, err := New(context.Background(), hosts[0], nopFrontend{}, "", ReadTimeout(100*time.Millisecond), MaxCommitLag(state.TickRate*60))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := rawClient(t, hosts[1], hosts[0])
+	go io.Copy(io.Discard, s) // reads fine, but never sends anything, not even heartbeats
+
+	waitForRemotes(t, n, 1, func(Stats) {})
+	waitForRemotes(t, n, 0, func(Stats) {})
+}
+
+func TestIdlePeerGetsHeartbeats(t *testing.T) {
+	hosts := newMocknet(t, 2)
+	_, err := New(context.Background(), hosts[0], nopFrontend{}, "", HeartbeatInterval(10*time.Millisecond), PingInterval(0), ClockSyncInterval(0), ReadTimeout(0), MaxCommitLag(state.TickRate*60))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// we never send CommitTick so the server can't commit and has nothing to tell us, except heartbeats.
+	s := rawClient(t, hosts[1], hosts[0])
+	var b [8]byte // when + player
+	var c rpcgame.Command
+	for heartbeats := 0; heartbeats < 3; {
+		if _, err := io.ReadFull(s, b[:]); err != nil {
+			t.Fatal(err)
+		}
+		if player := binary.LittleEndian.Uint32(b[4:]); player != 0 {
+			t.Fatalf("expected packets from the server (0); got from %d", player)
+		}
+		if err := rpcgame.ServerToClient.Read(s, &c); err != nil {
+			t.Fatal(err)
+		}
+		switch op := c.OpCode(); op {
+		case rpcgame.ServerHeartbeat:
+			heartbeats++
+		case rpcgame.CommitTick:
+			// the server can commit up to the tick we joined at
+		case rpcgame.RosterJoin, rpcgame.RosterUpdate:
+			// the roster in the catch-up and us joining it
+		default:
+			t.Fatalf("unexpected opcode %v", op)
+		}
+	}
+}
+
+type reconnectingFrontend struct {
+	nopFrontend
+	attempts chan uint32
+}
+
+func (f reconnectingFrontend) Reconnecting(attempt uint32) {
+	select {
+	case f.attempts <- attempt:
+	default:
+	}
+}
+
+func TestClientReconnects(t *testing.T) {
+	hosts := newMocknet(t, 2)
+	server, err := New(context.Background(), hosts[0], nopFrontend{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := reconnectingFrontend{attempts: make(chan uint32, 16)}
+	client, err := New(context.Background(), hosts[1], f, hosts[0].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForRemotes(t, server, 1, func(Stats) {})
+	id := server.Stats().Remotes[0].ID
+
+	server.lk.Lock()
+	for _, p := range server.players {
+		server.disconnect(p, fmt.Errorf("test"))
+	}
+	server.lk.Unlock()
+
+	select {
+	case a := <-f.attempts:
+		if a != 1 {
+			t.Fatalf("expected first attempt to be 1; got %d", a)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("frontend was never told we are reconnecting")
+	}
+
+	waitForRemotes(t, server, 1, func(Stats) {})
+	if got := server.Stats().Remotes[0].ID; got != id {
+		t.Fatalf("expected to resume as player %d; got %d", id, got)
+	}
+
+	// make sure the new session is working, the server only commits once the client sends CommitTick and the client commits once the server tells it so.
+	commitNow := func() state.Time {
+		client.lk.Lock()
+		defer client.lk.Unlock()
+		return client.rollback.Commit.Now
+	}
+	resumedAt := commitNow()
+	waitFor(t, "the client to resume commiting", func() bool { return commitNow() >= resumedAt+state.TickRate/10 })
+}
+
+func TestInvalidCommandIsDisconnected(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cmd   []byte
+		ahead int // commit ticks sent before the command, so it is in the future of the server's Live
+	}{
+		{"DoNotUse", []byte{0, 0}, 0},
+		{"Unknown", binary.LittleEndian.AppendUint16(nil, 0x0700), 0},
+		{"ServerToClient", binary.LittleEndian.AppendUint16(nil, uint16(rpcgame.StateUpdate)), 0},
+		{"MissingPlane", func() []byte { c := rpcgame.EncodeGivePlaneHeading(1<<31, 0); return c.Bytes() }(), 0},
+		{"MissingPlaneAhead", func() []byte { c := rpcgame.EncodeGivePlaneHeading(1<<31, 0); return c.Bytes() }(), state.TickRate / 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hosts := newMocknet(t, 3)
+			n, err := New(context.Background(), hosts[0], nopFrontend{}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			good := rawClient(t, hosts[1], hosts[0])
+			go io.Copy(io.Discard, good)
+			go sendCommitTicks(good)
+
+			bad := rawClient(t, hosts[2], hosts[0])
+			go io.Copy(io.Discard, bad)
+			// the command is validated against Live, the first plane must have spawned in it.
+			waitFor(t, "the first plane to spawn", func() bool {
+				n.lk.Lock()
+				defer n.lk.Unlock()
+				return len(n.rollback.Live.Planes) != 0
+			})
+			var b []byte
+			for range tc.ahead {
+				tick := rpcgame.EncodeCommitTick()
+				b = append(b, tick.Bytes()...)
+			}
+			if _, err := bad.Write(append(b, tc.cmd...)); err != nil {
+				t.Fatal(err)
+			}
+
+			waitForRemotes(t, n, 1, func(Stats) {})
+			if id := n.Stats().Remotes[0].ID; id != 1 {
+				t.Fatalf("expected the good player (1) to stay; got %d", id)
+			}
+		})
+	}
+}
+
+func TestMesh(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		loss float64
+	}{
+		{"Delivers", 0},
+		{"FallsBackToReliable", 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hosts := newMocknet(t, 3)
+			_, err := New(context.Background(), hosts[0], nopFrontend{}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var clients [2]*Netcode
+			for i := range clients {
+				c, err := mesh.Listen("127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { c.Close() })
+				clients[i], err = New(context.Background(), hosts[1+i], nopFrontend{}, hosts[0].ID(), UnreliableMesh(mesh.Lossy(c, tc.loss)))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			sender, receiver := clients[0], clients[1]
+
+			waitFor(t, "the mesh to form and the first plane to spawn", func() bool {
+				sender.lk.Lock()
+				spawned := len(sender.rollback.Live.Planes) != 0
+				sender.lk.Unlock()
+				return spawned && sender.Stats().Mesh.Peers == 1
+			})
+
+			const heading = 1234
+			sender.Act(rpcgame.EncodeGivePlaneHeading(0, heading))
+			sender.lk.Lock()
+			senderId := sender.id
+			sender.lk.Unlock()
+			var commandedBy uint32
+			waitFor(t, "the command to be commited on the receiver", func() bool {
+				receiver.lk.Lock()
+				defer receiver.lk.Unlock()
+				planes := receiver.rollback.Commit.Planes
+				if len(planes) == 0 || planes[0].WantHeading != heading {
+					return false
+				}
+				commandedBy = planes[0].CommandedBy
+				return true
+			})
+			if commandedBy != senderId {
+				t.Fatalf("expected the plane to be commanded by the sender (%d); got %d", senderId, commandedBy)
+			}
+
+			received := receiver.Stats().Mesh.Received
+			switch {
+			case tc.loss == 0 && received != 1:
+				t.Fatalf("expected the command to arrive over the mesh; got %d", received)
+			case tc.loss == 1 && received != 0:
+				t.Fatalf("expected everything to be lost; got %d", received)
+			}
+		})
+	}
+}
+
+func TestRTTAndLead(t *testing.T) {
+	hosts := newMocknet(t, 2)
+	server, err := New(context.Background(), hosts[0], nopFrontend{}, "", PingInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := New(context.Background(), hosts[1], nopFrontend{}, hosts[0].ID(), PingInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "3 pings in each direction", func() bool {
+		server.lk.Lock()
+		var serverSamples uint64
+		for _, p := range server.players {
+			serverSamples = p.rtt.samples
+		}
+		server.lk.Unlock()
+		client.lk.Lock()
+		defer client.lk.Unlock()
+		return serverSamples >= 3 && client.server.rtt.samples >= 3
+	})
+
+	ss, cs := server.Stats().Remotes[0], client.Stats().Remotes[0]
+	if ss.RTT <= 0 || cs.RTT <= 0 {
+		t.Fatalf("expected positive round trip times; got server: %v client: %v", ss.RTT, cs.RTT)
+	}
+	// the lead is sent after the server's sample, give it time to arrive.
+	waitFor(t, "the client to run at the lead the server asked", func() bool {
+		return client.Stats().Remotes[0].Lead == server.Stats().Remotes[0].Lead
+	})
+}
+
+func TestSimulateNetwork(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	hosts := newMocknet(t, 2)
+	server, err := New(context.Background(), hosts[0], nopFrontend{}, "", PingInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = New(context.Background(), hosts[1], nopFrontend{}, hosts[0].ID(), SimulateNetwork(netsim.Conditions{Delay: delay}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r rtt
+	waitFor(t, "3 pings", func() bool {
+		server.lk.Lock()
+		defer server.lk.Unlock()
+		for _, p := range server.players {
+			r = p.rtt
+		}
+		return r.samples >= 3
+	})
+	// the client delays both directions.
+	if r.srtt < 2*delay {
+		t.Fatalf("expected the round trip time to include the simulated delay; got %v", r.srtt)
+	}
+}
+
+func TestLobby(t *testing.T) {
+	hosts := newMocknet(t, 2)
+	g := &manualGame{clock: manualclock.New()}
+	server, err := New(context.Background(), hosts[0], nopFrontend{}, "", Lobby(2), UseClock(g.clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := New(context.Background(), hosts[1], nopFrontend{}, hosts[0].ID(), UseClock(g.clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.server, g.clients = server, []*Netcode{client}
+	if err := server.SetName("host"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetName("guest"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetName("way too long for a name"); err == nil {
+		t.Fatal("expected the name to be rejected")
+	}
+
+	waitFor(t, "the roster", func() bool {
+		return slices.Equal(client.Roster(), []RosterEntry{{ID: 0, Name: "host"}, {ID: 1, Name: "guest"}})
+	})
+
+	client.SetReady(true)
+	waitFor(t, "the client to be ready", func() bool { return server.Roster()[1].Ready })
+	g.step(3)
+	server.lk.Lock()
+	live := server.rollback.Live.Now
+	server.lk.Unlock()
+	if live != 1 || server.Started() || client.Started() {
+		t.Fatalf("expected the game to wait for the host to be ready; live is at %d", live)
+	}
+	client.Act(rpcgame.EncodeGivePlaneHeading(0, 0)) // ignored in the lobby
+	if c := client.Stats().SendQueue; c != 0 {
+		t.Fatalf("expected commands to be ignored in the lobby; got %d queued", c)
+	}
+
+	server.SetReady(true)
+	g.step(state.TickRate)
+	waitFor(t, "the game to start", func() bool {
+		client.lk.Lock()
+		defer client.lk.Unlock()
+		return client.started && client.rollback.Commit.Now > 1
+	})
+	want := []RosterEntry{{ID: 0, Name: "host", Ready: true}, {ID: 1, Name: "guest", Ready: true}}
+	if r := client.Roster(); !slices.Equal(r, want) {
+		t.Fatalf("expected roster %v; got %v", want, r)
+	}
+}
+
+// chatFrontend records the chat messages it is given.
+type chatFrontend struct {
+	nopFrontend
+	lk       sync.Mutex
+	messages []string
+}
+
+func (f *chatFrontend) Chat(player uint32, callout uint8, text []byte) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.messages = append(f.messages, fmt.Sprintf("%d:%d:%s", player, callout, text))
+}
+
+func (f *chatFrontend) get() []string {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return slices.Clone(f.messages)
+}
+
+func TestChat(t *testing.T) {
+	hosts := newMocknet(t, 3)
+	var serverChat, clientChat, lateChat chatFrontend
+	server, err := New(context.Background(), hosts[0], &serverChat, "", ChatRateLimit(0.001, 2), ChatHistory(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := New(context.Background(), hosts[1], &clientChat, hosts[0].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the client to join", func() bool { return len(server.Roster()) == 2 })
+
+	if err := client.Chat(0, nil); err == nil {
+		t.Fatal("expected an empty message to be rejected")
+	}
+	for _, text := range []string{"hello", "world", "spam"} {
+		if err := client.Chat(0, []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"1:0:hello", "1:0:world"}
+	waitFor(t, "the client's messages", func() bool { return slices.Equal(clientChat.get(), want) })
+	waitFor(t, "the spam to be dropped", func() bool { return server.Stats().ChatDropped == 1 })
+	if err := server.Chat(3, nil); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "0:3:")
+	waitFor(t, "the server's message", func() bool { return slices.Equal(clientChat.get(), want) })
+	if m := serverChat.get(); !slices.Equal(m, want) {
+		t.Fatalf("expected the server to see %v; got %v", want, m)
+	}
+
+	if _, err := New(context.Background(), hosts[2], &lateChat, hosts[0].ID()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the history", func() bool { return slices.Equal(lateChat.get(), want[1:]) })
+}
+
+func TestPause(t *testing.T) {
+	const delay = state.TickRate / 4
+	// without pings nor clock sync the client runs with no lead, it restarts on the same tick as the server.
+	g := newManualGame(t, 1, 0, ResumeDelay(delay), PingInterval(0), ClockSyncInterval(0))
+	server, client := g.server, g.clients[0]
+
+	live := func(n *Netcode) state.State {
+		n.lk.Lock()
+		defer n.lk.Unlock()
+		return n.rollback.Live
+	}
+	waitFor(t, "the client to join", func() bool { return len(server.Roster()) == 2 })
+	g.step(state.TickRate)
+
+	client.Pause()
+	at := live(client).PauseAt
+	waitFor(t, "the server to get the pause", func() bool { l := live(server); return l.Pausing && l.PauseAt == at })
+	g.step(maxPauseLead * 2)
+	g.clock.BlockUntil(2) // the last tick is done once both loops sleep again
+	if !server.Paused() || !client.Paused() {
+		t.Fatal("expected everyone to pause")
+	}
+	if s, c := live(server).Now, live(client).Now; s != at || c != at {
+		t.Fatalf("expected everyone to freeze on tick %d; server is at %d, client at %d", at, s, c)
+	}
+
+	server.Resume()
+	waitFor(t, "the client to get the resume", func() bool { return !client.Paused() })
+	g.step(delay)
+	g.clock.BlockUntil(2)
+	if s, c := live(server).Now, live(client).Now; s != at || c != at {
+		t.Fatalf("expected everyone to wait the resume delay on tick %d; server is at %d, client at %d", at, s, c)
+	}
+	// the paused time is not caught up, ticking restarts from the frozen tick.
+	g.step(5)
+	g.clock.BlockUntil(2)
+	if s, c := live(server).Now, live(client).Now; s != at+5 || c != at+5 {
+		t.Fatalf("expected everyone to restart ticking from %d and be at %d; server is at %d, client at %d", at, at+5, s, c)
+	}
+	if server.Paused() || client.Paused() {
+		t.Fatal("expected the game to be resumed")
+	}
+}
+
+type kickedFrontend struct {
+	reconnectingFrontend
+	kicked chan rpcgame.Command
+}
+
+func (f kickedFrontend) Disconnected(c rpcgame.Command) { f.kicked <- c }
+
+// stoppedReconnecting returns true once the client c was disconnected after being told to stay away, it never dials the server again.
+func stoppedReconnecting(c *Netcode) bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.kicked && c.server.err != nil
+}
+
+func TestAdmin(t *testing.T) {
+	hosts := newMocknet(t, 3)
+	server, err := New(context.Background(), hosts[0], nopFrontend{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clients []*Netcode
+	var frontends []kickedFrontend
+	for _, h := range hosts[1:] {
+		f := kickedFrontend{reconnectingFrontend{attempts: make(chan uint32, 16)}, make(chan rpcgame.Command, 1)}
+		c, err := New(context.Background(), h, f, hosts[0].ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+		frontends = append(frontends, f)
+	}
+	waitForRemotes(t, server, 2, func(Stats) {})
+
+	if err := server.Kick(42); err == nil {
+		t.Fatal("expected kicking a player which is not connected to fail")
+	}
+	if err := clients[0].Kick(0); err == nil {
+		t.Fatal("expected clients to not be able to kick")
+	}
+
+	// resyncing reconnects it.
+	if err := server.Resync(clients[0].id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-frontends[0].attempts:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the client never reconnected")
+	}
+	waitForRemotes(t, server, 2, func(Stats) {})
+
+	kicked := func(f kickedFrontend, banned bool) {
+		t.Helper()
+		select {
+		case c := <-f.kicked:
+			if got := c[2] == 1; got != banned {
+				t.Fatalf("expected banned to be %v; got %v", banned, got)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("the client was never told it got kicked")
+		}
+	}
+
+	if err := server.Kick(clients[1].id); err != nil {
+		t.Fatal(err)
+	}
+	kicked(frontends[1], false)
+	waitForRemotes(t, server, 1, func(Stats) {})
+	if r := server.Roster(); len(r) != 2 {
+		t.Fatalf("expected the kicked player to leave the roster; got %v", r)
+	}
+
+	if err := server.Ban(hosts[1].ID()); err != nil {
+		t.Fatal(err)
+	}
+	kicked(frontends[0], true)
+	waitForRemotes(t, server, 0, func(Stats) {})
+
+	// kicked clients don't come back on their own, banned ones are refused.
+	for _, c := range clients {
+		waitFor(t, "the kicked client to stop", func() bool { return stoppedReconnecting(c) })
+	}
+	if r := server.Stats().Remotes; len(r) != 0 {
+		t.Fatalf("expected kicked clients to stay away; got %v", r)
+	}
+	s, err := hosts[1].NewStream(context.Background(), hosts[0].ID(), Proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+	if _, err := s.Write(append(currentVersion.append(nil), rolePlayer, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readVersion(s); err != nil {
+		t.Fatal(err)
+	}
+	var rejected *RejectedError
+	if err := readAdmission(s); !errors.As(err, &rejected) {
+		t.Fatalf("expected the banned peer to be refused; got %v", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	hosts := newMocknet(t, 3)
+	server, err := New(context.Background(), hosts[0], nopFrontend{}, "", Password("hunter2"), AllowPeers(hosts[1].ID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(context.Background(), hosts[1], nopFrontend{}, hosts[0].ID(), AllowPeers(hosts[1].ID())); err == nil {
+		t.Fatal("expected clients to not be able to pick the allowed peers")
+	}
+
+	for _, tc := range []struct {
+		name     string
+		h        host.Host
+		password string
+		reason   string
+	}{
+		{"WrongPassword", hosts[1], "hunter3", "wrong password"},
+		{"NoPassword", hosts[1], "", "wrong password"},
+		{"NotAllowed", hosts[2], "hunter2", "not allowed to join this room"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(context.Background(), tc.h, nopFrontend{}, hosts[0].ID(), Password(tc.password))
+			var rejected *RejectedError
+			if !errors.As(err, &rejected) || rejected.Reason != tc.reason {
+				t.Fatalf("expected to be rejected with %q; got %v", tc.reason, err)
+			}
+		})
+	}
+	if r := server.Stats().Remotes; len(r) != 0 {
+		t.Fatalf("expected rejected clients to not join; got %v", r)
+	}
+
+	if _, err := New(context.Background(), hosts[1], nopFrontend{}, hosts[0].ID(), Password("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	waitForRemotes(t, server, 1, func(Stats) {})
+}
+
+func TestIncompatibleVersion(t *testing.T) {
+	hosts := newMocknet(t, 2)
+	if _, err := New(context.Background(), hosts[0], nopFrontend{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		change func(*Netcode)
+		reason string
+	}{
+		{"Protocol", func(n *Netcode) { n.protocols[Proto] = gameProtocol{version: protocolVersion + 1} }, "your protocol version"},
+		{"State", func(n *Netcode) { n.version.state++ }, "your state format version"},
+		{"Rules", func(n *Netcode) { n.version.rules++ }, "your simulation rules"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(context.Background(), hosts[1], nopFrontend{}, hosts[0].ID(), tc.change)
+			var rejected *RejectedError
+			if !errors.As(err, &rejected) || !strings.HasPrefix(rejected.Reason, tc.reason) {
+				t.Fatalf("expected to be rejected with %q; got %v", tc.reason, err)
+			}
+		})
+	}
+}
+
+func TestOlderProtocol(t *testing.T) {
+	const older protocol.ID = "/hhs/0.9"
+	hosts := newMocknet(t, 3)
+	// the server still speaks the previous version while clients upgrade, here it's handler is the current one.
+	server, err := New(context.Background(), hosts[0], nopFrontend{}, "", func(n *Netcode) {
+		n.protocols[older] = gameProtocol{protocolVersion - 1, (*Netcode).handleStreamAsServer}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := New(context.Background(), hosts[1], nopFrontend{}, hosts[0].ID(), func(n *Netcode) {
+		n.protocols = map[protocol.ID]gameProtocol{older: {version: protocolVersion - 1}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := New(context.Background(), hosts[2], nopFrontend{}, hosts[0].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRemotes(t, server, 2, func(Stats) {})
+
+	for _, tc := range []struct {
+		c    *Netcode
+		want protocol.ID
+	}{{old, older}, {current, Proto}} {
+		tc.c.lk.Lock()
+		got := tc.c.server.s.Protocol()
+		tc.c.lk.Unlock()
+		if got != tc.want {
+			t.Fatalf("expected the client to negotiate %s; got %s", tc.want, got)
+		}
+	}
+
+	// rejections carry the version of the protocol they are sent on.
+	s, err := hosts[1].NewStream(context.Background(), hosts[0].ID(), older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+	wrong := version{protocolVersion - 1, state.FormatVersion + 1, state.RulesHash}
+	if _, err := s.Write(wrong.append(nil)); err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := readVersion(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theirs.protocol != protocolVersion-1 {
+		t.Fatalf("expected the rejection to carry the older protocol version %d; got %d", protocolVersion-1, theirs.protocol)
+	}
+	var rejected *RejectedError
+	if err := readAdmission(s); !errors.As(err, &rejected) {
+		t.Fatalf("expected to be rejected; got %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	hosts := newMocknet(t, 3)
+	var recorded bytes.Buffer
+	// the server would only notice silent clients after a minute, leaving must be faster.
+	server, err := New(context.Background(), hosts[0], nopFrontend{}, "", ReadTimeout(time.Minute), Record(&recorded, replay.Metadata{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	leaving, err := New(ctx, hosts[1], nopFrontend{}, hosts[0].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := kickedFrontend{reconnectingFrontend{attempts: make(chan uint32, 16)}, make(chan rpcgame.Command, 1)}
+	staying, err := New(context.Background(), hosts[2], f, hosts[0].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRemotes(t, server, 2, func(Stats) {})
+
+	// canceling the context closes it, it tells the server it leaves.
+	cancel()
+	waitForRemotes(t, server, 1, func(Stats) {})
+	if r := server.Roster(); len(r) != 2 {
+		t.Fatalf("expected the client to leave the roster; got %v", r)
+	}
+	if err := leaving.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-f.kicked:
+		if op := c.OpCode(); op != rpcgame.HostLeaving {
+			t.Fatalf("expected the client to be told the host is leaving; got %v", op)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the client was never told the host is leaving")
+	}
+	if err := server.Close(); err != nil {
+		t.Fatalf("expected closing again to be a no-op; got %v", err)
+	}
+	if recorded.Len() == 0 {
+		t.Fatal("expected the replay to be written")
+	}
+
+	// clients don't try to reconnect to a host which is gone.
+	waitFor(t, "the client to stop", func() bool { return stoppedReconnecting(staying) })
+	select {
+	case a := <-f.attempts:
+		t.Fatalf("expected the client to stay away; got reconnection attempt %d", a)
+	default:
+	}
+	if err := staying.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+package netcode
+
+import (
+	"github.com/Jorropo/OpenAirways/rollback"
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+	"github.com/Jorropo/OpenAirways/state"
+)
+
+// Ownership splits the planes between the players in the roster, each player can only command the planes it owns.
+// New planes are assigned round robin, players give them to each other with [Netcode.Handoff] and the planes of players leaving are split between the others.
+func Ownership() Option {
+	return func(n *Netcode) {
+		n.ownership = true
+	}
+}
+
+// Handoff gives the plane with this id to player, it is ignored if we don't own it.
+func (n *Netcode) Handoff(plane, player uint32) {
+	n.Act(rpcgame.EncodeHandoff(plane, player))
+}
+
+// ownershipPending returns true if planes may change hands after live up to tick at included.
+// A command about a plane the sender does not own in live could then be racing with it and must go through.
+// Must be called holding [n.lk].
+func (n *Netcode) ownershipPending(at state.Time) bool {
+	live := n.rollback.Live.Now
+	for c := range n.rollback.Joins {
+		if c.HappendAt < live || c.HappendAt > at {
+			continue
+		}
+		switch c.Op.OpCode() {
+		case rpcgame.Handoff, rpcgame.SetController:
+			return true
+		}
+	}
+	return false
+}
+
+// setController adds or removes player id from the players planes are split between.
+// It goes through rollback like the host's own commands so everyone agrees on which tick the planes changed hands.
+// Must be called holding [n.lk].
+func (n *Netcode) setController(id uint32, on bool) {
+	if !n.ownership {
+		return
+	}
+	now := n.rollback.Live.Now
+	cmd := rpcgame.EncodeSetController(id, on)
+	if n.rollback.Do(rollback.Command{Op: cmd, Player: 0, Reliable: true, HappendAt: now}) {
+		n.stateCond.Broadcast()
+	}
+	if n.pushSent(0, now, cmd) {
+		n.sendCond.Broadcast()
+	}
+}
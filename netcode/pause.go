@@ -0,0 +1,138 @@
+package netcode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+	"github.com/Jorropo/OpenAirways/state"
+)
+
+const (
+	// maxPauseLead is the furthest in the future of the tick it is sent on a pause can be scheduled.
+	// A pending pause blocks the others so the server clamps the ones further away.
+	maxPauseLead = state.TickRate
+	// MaxResumeDelay is the longest [ResumeDelay], the server clamps longer ones.
+	MaxResumeDelay = state.TickRate * 10
+)
+
+// ResumeDelay sets how many ticks worth of time everyone waits after we resume the game, it gives players a countdown.
+// It is capped to [MaxResumeDelay].
+func ResumeDelay(ticks state.Time) Option {
+	return func(n *Netcode) {
+		n.resumeDelay = min(ticks, MaxResumeDelay)
+	}
+}
+
+// Pause freezes the game for everyone, it happens shortly in the future so all peers stop on the same tick.
+// It is ignored while waiting in the lobby and when spectating.
+func (n *Netcode) Pause() {
+	n.lk.Lock()
+	at := n.rollback.Live.Now + n.pauseLead()
+	n.lk.Unlock()
+	n.Act(rpcgame.EncodePause(uint32(at)))
+}
+
+// pauseLead returns how far in the future of our live a pause is scheduled so every peer gets it before reaching it's tick.
+// It is the largest lead plus round trip seen across the players, on a client only the server's is known so ours stands for the others.
+// Peers which still ticked past it resync by reconnecting.
+// Must be called holding [n.lk].
+func (n *Netcode) pauseLead() state.Time {
+	var lead state.Time = 1
+	need := func(p *player) {
+		budget := p.rtt.srtt + 2*p.rtt.rttvar
+		lead = max(lead, p.lead+state.Time((budget+waitPerTick-1)/waitPerTick))
+	}
+	if n.target != "" {
+		if n.server != nil {
+			need(n.server)
+		}
+	} else {
+		for _, p := range n.players {
+			if p.err == nil && !p.spectator {
+				need(p)
+			}
+		}
+	}
+	return min(lead, maxPauseLead)
+}
+
+// clampPause bounds the pause or resume c received from a client which sent it on tick at.
+// Honest clients never go past the bounds, they exist so a client can't block pausing by scheduling a pause far away or freeze the game with a huge delay.
+func clampPause(c *rpcgame.Command, at state.Time) {
+	switch c.OpCode() {
+	case rpcgame.Pause:
+		if pauseAt := binary.LittleEndian.Uint32(c[2:]); pauseAt > uint32(at+maxPauseLead) {
+			binary.LittleEndian.PutUint32(c[2:], uint32(at+maxPauseLead))
+		}
+	case rpcgame.Resume:
+		if delay := binary.LittleEndian.Uint32(c[2:]); delay > MaxResumeDelay {
+			binary.LittleEndian.PutUint32(c[2:], MaxResumeDelay)
+		}
+	}
+}
+
+// Resume restarts a paused game for everyone after the [ResumeDelay].
+func (n *Netcode) Resume() {
+	n.Act(rpcgame.EncodeResume(uint32(n.resumeDelay)))
+}
+
+// Paused returns true while the game is frozen.
+func (n *Netcode) Paused() bool {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	return n.rollback.Live.Frozen()
+}
+
+// scheduleResume sets when the tick loop restarts after the Resume c, serverGotItAt is our estimate of when the server applied it.
+// Clients restart their lead earlier so they stay ahead of the server like they were before the pause.
+// Must be called holding [n.lk].
+func (n *Netcode) scheduleResume(c rpcgame.Command, serverGotItAt time.Time) {
+	at := serverGotItAt.Add(time.Duration(binary.LittleEndian.Uint32(c[2:])) * waitPerTick)
+	if n.server != nil {
+		at = at.Add(-time.Duration(n.server.lead) * waitPerTick)
+	}
+	n.resumeAt = at
+}
+
+// missedPause returns an error if our live ticked past a pause we learned about too late.
+// We can't go back in time so the client resyncs by reconnecting.
+// Must be called holding [n.lk].
+func (n *Netcode) missedPause() error {
+	if l := &n.rollback.Live; l.Pausing && l.Now > l.PauseAt {
+		return fmt.Errorf("live is at %d, past the pause at %d", l.Now, l.PauseAt)
+	}
+	return nil
+}
+
+// waitWhilePaused blocks the tick loop while live is frozen, it returns when live starts ticking from again.
+// The pause is not caught up, ticking restarts where it stopped.
+// The peers are still kept alive and timed out while waiting.
+// It returns false if the server was lost or we are closing while waiting.
+func (n *Netcode) waitWhilePaused(server *player) (_ time.Time, ok bool) {
+	for {
+		n.lk.Lock()
+		if server != nil && server.err != nil || n.closing {
+			n.lk.Unlock()
+			return time.Time{}, false
+		}
+		now := n.clock.Now()
+		if !n.rollback.Live.Frozen() {
+			start := n.resumeAt
+			n.resumeAt = time.Time{}
+			n.lk.Unlock()
+			if start.IsZero() {
+				return now, true // a rollback removed the pause
+			}
+			if d := start.Sub(now); d > 0 {
+				n.clock.Sleep(d)
+			}
+			return start, true
+		}
+		n.enforceTimeouts(now)
+		n.lk.Unlock()
+
+		n.clock.Sleep(waitPerTick)
+	}
+}
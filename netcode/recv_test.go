@@ -0,0 +1,92 @@
+package netcode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+)
+
+// BenchmarkHeadOfLineBurst receives a burst of commands which are all in the past of live, like after a Head-Of-Line event.
+// With a tiny read buffer commands are mostly handled one by one, like the receive loops did before batching.
+func BenchmarkHeadOfLineBurst(b *testing.B) {
+	const live = 100
+	var burst []byte
+	for i := range live - 1 {
+		burst = binary.LittleEndian.AppendUint32(burst, uint32(1+i))
+		burst = binary.LittleEndian.AppendUint32(burst, 1)
+		cmd := rpcgame.EncodeGivePlaneHeading(0, rpcgame.Rot16(i))
+		burst = append(burst, cmd.Bytes()...)
+	}
+
+	for _, bc := range []struct {
+		name string
+		size int
+	}{
+		{"PerCommand", 16}, // the smallest bufio allows, it rarely holds more than one command
+		{"Batched", 4096},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var rollbacks, locks uint64
+			for range b.N {
+				b.StopTimer()
+				n := &Netcode{clock: realClock{}, target: "server"}
+				n.stateCond.L = &n.lk
+				n.sendCond.L = &n.lk
+				n.rollback.Live.Tick() // live must start in commit's future
+				for range live - 1 {
+					n.rollback.TickLive()
+				}
+				r := bufio.NewReaderSize(bytes.NewReader(burst), bc.size)
+				b.StartTimer()
+
+				if err := n.clientRecv(&player{}, r); !errors.Is(err, io.EOF) {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				if n.recvCommands != live-1 {
+					b.Fatalf("expected %d commands; got %d", live-1, n.recvCommands)
+				}
+				rollbacks += n.rollback.Stats().Rollbacks
+				locks += n.recvBatches
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(rollbacks)/float64(b.N), "rollbacks/op")
+			b.ReportMetric(float64(locks)/float64(b.N), "locks/op")
+		})
+	}
+}
+
+func TestCommandBuffered(t *testing.T) {
+	c := rpcgame.EncodeGivePlaneHeading(1, 2)
+	cmd := c.Bytes()
+	chat := rpcgame.EncodeChat(0, []byte("hi"))
+	chatCmd := append(chat.Bytes(), "hi"...)
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"Empty", nil, false},
+		{"OpCodeOnly", cmd[:2], false},
+		{"Partial", cmd[:7], false},
+		{"Whole", cmd, true},
+		{"Unknown", []byte{0xff, 0xff}, true},
+		{"PayloadMissing", chatCmd[:4], false},
+		{"PayloadPartial", chatCmd[:5], false},
+		{"PayloadWhole", chatCmd, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tc.b))
+			r.Peek(len(tc.b)) // fill the buffer
+			if got := commandBuffered(r, 0); got != tc.want {
+				t.Fatalf("expected %v; got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package netcode
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"time"
+
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+)
+
+// RosterEntry is a player in the game as the server sees it.
+type RosterEntry struct {
+	ID    uint32
+	Name  string
+	Ready bool
+}
+
+// Lobby makes the server wait in a lobby before the simulation starts ticking.
+// The game starts once at least minPlayers players, us included, are in the roster and all of them are ready.
+// Players joining once the game started skip the lobby.
+func Lobby(minPlayers uint32) Option {
+	return func(n *Netcode) {
+		n.lobby = true
+		n.minPlayers = minPlayers
+	}
+}
+
+// SetName changes our name in the roster, it must be valid according to [rpcgame.ValidName].
+func (n *Netcode) SetName(name string) error {
+	if err := rpcgame.ValidName(name); err != nil {
+		return err
+	}
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if n.target == "" {
+		e := n.roster[0]
+		e.Name = name
+		n.rosterUpdated(e)
+		return nil
+	}
+	n.name = name
+	n.rosterDue()
+	return nil
+}
+
+// SetReady tells everyone in the lobby if we are ready to start the game.
+func (n *Netcode) SetReady(ready bool) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if n.target == "" {
+		e := n.roster[0]
+		e.Ready = ready
+		n.rosterUpdated(e)
+		return
+	}
+	n.ready = ready
+	n.rosterDue()
+}
+
+// Roster returns the players in the game sorted by id, on clients it is our latest copy of the server's roster.
+func (n *Netcode) Roster() []RosterEntry {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	r := make([]RosterEntry, 0, len(n.roster))
+	for _, e := range n.roster {
+		r = append(r, *e)
+	}
+	slices.SortFunc(r, func(a, b RosterEntry) int { return cmp.Compare(a.ID, b.ID) })
+	return r
+}
+
+// Started returns false while we are waiting in the lobby.
+func (n *Netcode) Started() bool {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	return n.started
+}
+
+// rosterDue makes the client's write loop send our name and ready state to the server.
+// Must be called holding [n.lk].
+func (n *Netcode) rosterDue() {
+	if n.spectator {
+		return // spectators are not in the roster
+	}
+	if n.server == nil || n.server.err != nil {
+		return // resume will send it
+	}
+	n.server.rosterDue = true
+	n.sendCond.Broadcast()
+}
+
+// rosterEvent is a roster change waiting to be given to the frontend.
+type rosterEvent struct {
+	c    rpcgame.Command
+	name string // payload of RosterUpdate
+}
+
+// rosterChanged gives c to the frontend and on the server relays it to every client, name is the payload of RosterUpdate.
+// Must be called holding [n.lk].
+func (n *Netcode) rosterChanged(c rpcgame.Command, name string) {
+	n.rosterEvents = append(n.rosterEvents, rosterEvent{c, name})
+	n.stateCond.Broadcast()
+	if n.target == "" && n.pushSentPayload(0, n.rollback.Commit.Now, c, []byte(name)) {
+		n.sendCond.Broadcast()
+	}
+}
+
+// rosterUpdated tells everyone about e's name and ready state.
+// Must be called holding [n.lk].
+func (n *Netcode) rosterUpdated(e *RosterEntry) {
+	n.rosterChanged(rpcgame.EncodeRosterUpdate(e.ID, e.Ready, e.Name), e.Name)
+}
+
+// appendRoster appends the current roster to a server to client catch-up.
+// Must be called holding [n.lk].
+func (n *Netcode) appendRoster(b []byte) []byte {
+	for _, e := range n.roster {
+		for _, c := range [...]rpcgame.Command{rpcgame.EncodeRosterJoin(e.ID), rpcgame.EncodeRosterUpdate(e.ID, e.Ready, e.Name)} {
+			b = binary.LittleEndian.AppendUint32(b, uint32(n.rollback.Commit.Now))
+			b = binary.LittleEndian.AppendUint32(b, 0)
+			b = append(b, c.Bytes()...)
+		}
+		b = append(b, e.Name...) // payload of the RosterUpdate
+	}
+	return b
+}
+
+// rosterJoin adds player id to the server's roster.
+// Must be called holding [n.lk].
+func (n *Netcode) rosterJoin(id uint32) {
+	n.roster[id] = &RosterEntry{ID: id}
+	n.rosterChanged(rpcgame.EncodeRosterJoin(id), "")
+	n.setController(id, true)
+}
+
+// rosterLeave removes player id from the server's roster.
+// Must be called holding [n.lk].
+func (n *Netcode) rosterLeave(id uint32) {
+	if _, ok := n.roster[id]; !ok {
+		return
+	}
+	delete(n.roster, id)
+	n.rosterChanged(rpcgame.EncodeRosterLeave(id), "")
+	n.setController(id, false)
+}
+
+// gotRosterCommand handles SetName and SetReady from p on the server, name is the payload of SetName.
+// Must be called holding [n.lk].
+func (n *Netcode) gotRosterCommand(p *player, c rpcgame.Command, name []byte) error {
+	e, ok := n.roster[p.id]
+	if !ok {
+		return nil // already left
+	}
+	switch c.OpCode() {
+	case rpcgame.SetName:
+		if err := rpcgame.ValidName(string(name)); err != nil {
+			return fmt.Errorf("invalid name: %w", err)
+		}
+		e.Name = string(name)
+	case rpcgame.SetReady:
+		if c[2] > 1 {
+			return fmt.Errorf("invalid ready state: %d", c[2])
+		}
+		e.Ready = c[2] == 1
+	}
+	n.rosterUpdated(e)
+	return nil
+}
+
+// gotRosterUpdate updates the client's copy of the roster, name is the payload of RosterUpdate.
+// Must be called holding [n.lk].
+func (n *Netcode) gotRosterUpdate(c rpcgame.Command, name []byte) error {
+	id := binary.LittleEndian.Uint32(c[2:])
+	switch c.OpCode() {
+	case rpcgame.RosterJoin:
+		n.roster[id] = &RosterEntry{ID: id}
+	case rpcgame.RosterLeave:
+		delete(n.roster, id)
+	case rpcgame.RosterUpdate:
+		e, ok := n.roster[id]
+		if !ok {
+			return fmt.Errorf("update for player %d which is not in the roster", id)
+		}
+		if err := rpcgame.ValidName(string(name)); err != nil {
+			return fmt.Errorf("invalid name: %w", err)
+		}
+		e.Name = string(name)
+		e.Ready = c[6] == 1
+	}
+	n.rosterChanged(c, string(name))
+	return nil
+}
+
+// gotGameStart makes the client leave the lobby.
+// Live starts ticking one tick after the server sent it, we estimate when that was from the round trip time.
+// Must be called holding [n.lk].
+func (n *Netcode) gotGameStart(p *player, now time.Time) {
+	if n.started {
+		return
+	}
+	n.started = true
+	n.startedAt = now.Add(-p.rtt.srtt / 2)
+	n.rosterChanged(rpcgame.EncodeGameStart(), "")
+}
+
+// lobbyReady returns true if the server can start the game.
+// Must be called holding [n.lk].
+func (n *Netcode) lobbyReady() bool {
+	if uint32(len(n.roster)) < n.minPlayers {
+		return false
+	}
+	for _, e := range n.roster {
+		if !e.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// waitInLobby blocks the tick loop until the game starts, it returns when live starts ticking from.
+// The peers are still kept alive and timed out while waiting.
+// It returns false if the server was lost or we are closing while waiting.
+func (n *Netcode) waitInLobby(start time.Time, server *player) (_ time.Time, ok bool) {
+	for {
+		n.lk.Lock()
+		if server != nil && server.err != nil || n.closing {
+			n.lk.Unlock()
+			return time.Time{}, false
+		}
+		if n.started {
+			if server != nil {
+				start = n.startedAt
+			}
+			n.lk.Unlock()
+			return start, true
+		}
+		now := n.clock.Now()
+		if server == nil && n.lobbyReady() {
+			n.started = true
+			n.rosterChanged(rpcgame.EncodeGameStart(), "")
+			n.lk.Unlock()
+			return now, true
+		}
+		n.enforceTimeouts(now)
+		n.lk.Unlock()
+
+		if server != nil {
+			// nothing is rendered before the game starts but the frontend wants the roster.
+			n.startRenderLoop()
+		}
+		n.clock.Sleep(waitPerTick)
+	}
+}
@@ -0,0 +1,36 @@
+package netcode
+
+import (
+	"time"
+
+	"github.com/Jorropo/OpenAirways/state"
+)
+
+// rtt is a smoothed round trip time estimator, it works like TCP's (RFC 6298).
+type rtt struct {
+	srtt    time.Duration
+	rttvar  time.Duration // jitter
+	samples uint64
+}
+
+func (r *rtt) sample(d time.Duration) {
+	if r.samples == 0 {
+		r.srtt = d
+		r.rttvar = d / 2
+	} else {
+		diff := r.srtt - d
+		if diff < 0 {
+			diff = -diff
+		}
+		r.rttvar = (3*r.rttvar + diff) / 4
+		r.srtt = (7*r.srtt + d) / 8
+	}
+	r.samples++
+}
+
+// lead returns how many ticks ahead of us a peer should run so that its commands reach us before we are past them.
+// It budgets one way latency plus twice the jitter.
+func (r *rtt) lead() state.Time {
+	budget := r.srtt/2 + 2*r.rttvar
+	return state.Time((budget + waitPerTick - 1) / waitPerTick)
+}
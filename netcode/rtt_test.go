@@ -0,0 +1,39 @@
+package netcode
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Jorropo/OpenAirways/state"
+)
+
+func TestRTTConverges(t *testing.T) {
+	var r rtt
+	for range 100 {
+		r.sample(40 * time.Millisecond)
+	}
+	if r.srtt != 40*time.Millisecond {
+		t.Fatalf("expected srtt to converge to 40ms; got %v", r.srtt)
+	}
+	if r.rttvar > time.Millisecond {
+		t.Fatalf("expected no jitter on a constant rtt; got %v", r.rttvar)
+	}
+	// 20ms one way is 1.2 ticks at 60Hz
+	if lead := r.lead(); lead != 2 {
+		t.Fatalf("expected a lead of 2 ticks; got %d", lead)
+	}
+
+	// alternate between 20ms and 60ms, the average stays the same but the jitter increases the lead.
+	for i := range 100 {
+		r.sample(time.Duration(20+40*(i%2)) * time.Millisecond)
+	}
+	if r.srtt < 35*time.Millisecond || r.srtt > 45*time.Millisecond {
+		t.Fatalf("expected srtt to stay around 40ms; got %v", r.srtt)
+	}
+	if r.rttvar < 15*time.Millisecond {
+		t.Fatalf("expected jitter to be around 20ms; got %v", r.rttvar)
+	}
+	if lead := r.lead(); lead < state.Time((20*time.Millisecond+2*15*time.Millisecond)/(time.Second/state.TickRate)) {
+		t.Fatalf("expected the lead to cover the jitter; got %d", lead)
+	}
+}
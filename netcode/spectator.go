@@ -0,0 +1,15 @@
+package netcode
+
+// The role is the first byte clients send when connecting.
+const (
+	rolePlayer byte = iota
+	roleSpectator
+)
+
+// Spectate makes the client watch the game without playing.
+// Spectators get the commited state and the relayed commands like players but never block commits, they are not in the roster and can't act nor chat.
+func Spectate() Option {
+	return func(n *Netcode) {
+		n.spectator = true
+	}
+}
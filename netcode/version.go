@@ -0,0 +1,89 @@
+package netcode
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/Jorropo/OpenAirways/state"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Proto is the current version of the game stream, the version in it is bumped when the handshake or the framing changes.
+const Proto protocol.ID = "/hhs/1.0"
+
+// protocolVersion is the version of [Proto], peers also exchange it in the handshake.
+const protocolVersion = 1
+
+// gameProtocol is one version of the game stream.
+type gameProtocol struct {
+	version uint16                                   // exchanged in the handshake, peers must agree on it for the protocol id they negotiated
+	handle  func(n *Netcode, s network.Stream) error // server side of the stream
+}
+
+// gameProtocols are the versions of the game stream we speak, clients offer them newest first and the server picks the first one it knows.
+// To roll out an upgrade register the new one along the previous ones with the handlers speaking them until every client upgraded.
+var gameProtocols = map[protocol.ID]gameProtocol{
+	Proto: {protocolVersion, (*Netcode).handleStreamAsServer},
+}
+
+// offer returns the protocol ids of the game stream we speak, newest first.
+func (n *Netcode) offer() []protocol.ID {
+	return slices.SortedFunc(maps.Keys(n.protocols), func(a, b protocol.ID) int {
+		return cmp.Compare(n.protocols[b].version, n.protocols[a].version)
+	})
+}
+
+// versionOn returns the version we run on a game stream negotiated to proto.
+func (n *Netcode) versionOn(proto protocol.ID) version {
+	v := n.version
+	v.protocol = n.protocols[proto].version
+	return v
+}
+
+// version is what peers must agree on to play together, it is the first thing both sides send on the game stream.
+type version struct {
+	protocol uint16 // handshake and framing
+	state    uint16 // [state.FormatVersion]
+	rules    uint64 // [state.RulesHash]
+}
+
+var currentVersion = version{protocolVersion, state.FormatVersion, state.RulesHash}
+
+const versionSize = 2 + 2 + 8
+
+func (v version) append(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, v.protocol)
+	b = binary.LittleEndian.AppendUint16(b, v.state)
+	return binary.LittleEndian.AppendUint64(b, v.rules)
+}
+
+func readVersion(r io.Reader) (version, error) {
+	var b [versionSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return version{}, fmt.Errorf("reading version: %w", err)
+	}
+	return version{
+		protocol: binary.LittleEndian.Uint16(b[:]),
+		state:    binary.LittleEndian.Uint16(b[2:]),
+		rules:    binary.LittleEndian.Uint64(b[4:]),
+	}, nil
+}
+
+// compatible returns an error explaining why we can't play with a peer running theirs, it is addressed to them.
+// v must be the one of the protocol id the stream was negotiated to, see [Netcode.versionOn].
+func (v version) compatible(theirs version) error {
+	switch {
+	case v.protocol != theirs.protocol:
+		return fmt.Errorf("your protocol version %d does not match ours %d, both sides need the same version of the game", theirs.protocol, v.protocol)
+	case v.state != theirs.state:
+		return fmt.Errorf("your state format version %d does not match ours %d, both sides need the same version of the game", theirs.state, v.state)
+	case v.rules != theirs.rules:
+		return fmt.Errorf("your simulation rules %016x do not match ours %016x, both sides need the same version of the game", theirs.rules, v.rules)
+	}
+	return nil
+}
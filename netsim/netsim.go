@@ -0,0 +1,415 @@
+// Package netsim simulates bad network conditions on top of a good one, it is used to tune the netcode without real networks.
+//
+// Game streams are reliable and ordered, so lost and late packets show up the way they do on TCP:
+// the write is held back (for a retransmission timeout or for being late) and everything written after it waits behind it.
+// Nothing is ever delivered out of order.
+package netsim
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+type Distribution uint8
+
+const (
+	Uniform Distribution = iota // jitter is uniformly distributed in [0, Jitter)
+	Normal                      // jitter is the absolute value of a normal distribution of standard deviation Jitter
+)
+
+func (d Distribution) String() string {
+	switch d {
+	case Uniform:
+		return "uniform"
+	case Normal:
+		return "normal"
+	default:
+		return "Distribution(" + strconv.FormatUint(uint64(d), 10) + ")"
+	}
+}
+
+// Conditions describe one direction of a link, [Wrap] applies them to both.
+type Conditions struct {
+	Delay        time.Duration // one way latency
+	Jitter       time.Duration // added on top of Delay, following Distribution
+	Distribution Distribution
+	Loss         float64 // probability a write is lost and has to be retransmitted
+	Late         float64 // probability a write is held back for an extra Delay + Jitter, the ones following it wait for it
+	Bandwidth    uint64  // bytes per second, zero is unlimited
+	StallFor     time.Duration
+	StallEvery   time.Duration // the link stops delivering anything for StallFor at the end of every StallEvery
+}
+
+func (c Conditions) IsZero() bool {
+	return c == Conditions{}
+}
+
+// String returns c in the format accepted by [Parse].
+func (c Conditions) String() string {
+	var parts []string
+	if c.Delay != 0 {
+		parts = append(parts, "delay="+c.Delay.String())
+	}
+	if c.Jitter != 0 {
+		parts = append(parts, "jitter="+c.Jitter.String())
+	}
+	if c.Distribution != Uniform {
+		parts = append(parts, "dist="+c.Distribution.String())
+	}
+	if c.Loss != 0 {
+		parts = append(parts, "loss="+strconv.FormatFloat(c.Loss, 'g', -1, 64))
+	}
+	if c.Late != 0 {
+		parts = append(parts, "late="+strconv.FormatFloat(c.Late, 'g', -1, 64))
+	}
+	if c.Bandwidth != 0 {
+		parts = append(parts, "bandwidth="+strconv.FormatUint(c.Bandwidth, 10))
+	}
+	if c.StallFor != 0 || c.StallEvery != 0 {
+		parts = append(parts, "stall="+c.StallFor.String()+"/"+c.StallEvery.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// Parse reads conditions written as comma separated key=value pairs, for example:
+//
+//	delay=50ms,jitter=10ms,dist=normal,loss=0.01,late=0.05,bandwidth=64000,stall=2s/30s
+//
+// bandwidth is in bytes per second and stall is for/every. Missing keys are zero.
+func Parse(spec string) (Conditions, error) {
+	var c Conditions
+	if spec == "" {
+		return c, nil
+	}
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return Conditions{}, fmt.Errorf("missing = in %q", kv)
+		}
+		var err error
+		switch k {
+		case "delay":
+			c.Delay, err = time.ParseDuration(v)
+		case "jitter":
+			c.Jitter, err = time.ParseDuration(v)
+		case "dist":
+			switch v {
+			case "uniform":
+				c.Distribution = Uniform
+			case "normal":
+				c.Distribution = Normal
+			default:
+				err = fmt.Errorf("unknown distribution")
+			}
+		case "loss":
+			c.Loss, err = parseProbability(v)
+		case "late":
+			c.Late, err = parseProbability(v)
+		case "bandwidth":
+			c.Bandwidth, err = strconv.ParseUint(v, 10, 64)
+		case "stall":
+			f, e, ok := strings.Cut(v, "/")
+			if !ok {
+				err = fmt.Errorf("expected for/every")
+				break
+			}
+			if c.StallFor, err = time.ParseDuration(f); err != nil {
+				break
+			}
+			if c.StallEvery, err = time.ParseDuration(e); err != nil {
+				break
+			}
+			if c.StallFor > c.StallEvery {
+				err = fmt.Errorf("stalling for longer than the period")
+			}
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return Conditions{}, fmt.Errorf("parsing %q: %w", kv, err)
+		}
+	}
+	if c.Delay < 0 || c.Jitter < 0 || c.StallFor < 0 {
+		return Conditions{}, fmt.Errorf("negative duration in %q", spec)
+	}
+	return c, nil
+}
+
+func parseProbability(v string) (float64, error) {
+	p, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	if !(p >= 0 && p <= 1) {
+		return 0, fmt.Errorf("probability %v is not between 0 and 1", p)
+	}
+	return p, nil
+}
+
+// Clock is the time source delays are measured with, netcode passes the one it ticks with.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in it's own goroutine once d has passed, unless stop is called first.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// realClock is used when [Wrap] is not given a [Clock].
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// minRTO is the smallest retransmission timeout, like Linux's TCP.
+const minRTO = 200 * time.Millisecond
+
+// maxQueued is how many bytes can be in flight in one direction before writes block, like a socket buffer.
+const maxQueued = 64 << 10
+
+var errClosed = errors.New("netsim: closed")
+
+type chunk struct {
+	b   []byte
+	due time.Time
+}
+
+// pipe delays chunks according to the conditions and delivers them in order.
+type pipe struct {
+	c     Conditions
+	clock Clock
+	epoch time.Time // stalls are scheduled from it
+
+	lk        sync.Mutex
+	cond      sync.Cond
+	queue     []chunk
+	queued    int       // bytes in queue
+	busyUntil time.Time // when the bandwidth limited sender is done with what it already sent
+	lastDue   time.Time // chunks are never delivered before the ones pushed earlier
+	err       error     // returned once the queue is drained
+}
+
+func newPipe(c Conditions, clock Clock) *pipe {
+	p := &pipe{c: c, clock: clock, epoch: clock.Now()}
+	p.cond.L = &p.lk
+	return p
+}
+
+func (p *pipe) jitter() time.Duration {
+	if p.c.Jitter <= 0 {
+		return 0
+	}
+	switch p.c.Distribution {
+	case Normal:
+		return time.Duration(math.Abs(mrand.NormFloat64()) * float64(p.c.Jitter))
+	default:
+		return mrand.N(p.c.Jitter)
+	}
+}
+
+// afterStalls pushes due past the stall it falls in, if any.
+func (p *pipe) afterStalls(due time.Time) time.Time {
+	if p.c.StallEvery <= 0 || p.c.StallFor <= 0 {
+		return due
+	}
+	phase := due.Sub(p.epoch) % p.c.StallEvery
+	if phase >= p.c.StallEvery-p.c.StallFor {
+		due = due.Add(p.c.StallEvery - phase)
+	}
+	return due
+}
+
+// push queues b, it blocks while too many bytes are in flight.
+func (p *pipe) push(b []byte) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for p.queued >= maxQueued && p.err == nil {
+		p.cond.Wait()
+	}
+	if p.err != nil {
+		return p.err
+	}
+
+	now := p.clock.Now()
+	due := now
+	if p.c.Bandwidth != 0 {
+		start := now
+		if p.busyUntil.After(start) {
+			start = p.busyUntil
+		}
+		p.busyUntil = start.Add(time.Duration(uint64(len(b)) * uint64(time.Second) / p.c.Bandwidth))
+		due = p.busyUntil
+	}
+	due = due.Add(p.c.Delay + p.jitter())
+	if mrand.Float64() < p.c.Loss {
+		due = due.Add(max(minRTO, 2*p.c.Delay))
+	}
+	if mrand.Float64() < p.c.Late {
+		due = due.Add(p.c.Delay + p.c.Jitter)
+	}
+	due = p.afterStalls(due)
+	if due.Before(p.lastDue) {
+		due = p.lastDue
+	}
+	p.lastDue = due
+
+	p.queue = append(p.queue, chunk{b, due})
+	p.queued += len(b)
+	p.cond.Broadcast()
+	return nil
+}
+
+// pop blocks until the next chunk is due and returns it, or the error once everything was delivered.
+func (p *pipe) pop() ([]byte, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for {
+		if len(p.queue) != 0 {
+			wait := p.queue[0].due.Sub(p.clock.Now())
+			if wait <= 0 {
+				c := p.queue[0]
+				p.queue = p.queue[1:]
+				p.queued -= len(c.b)
+				p.cond.Broadcast()
+				return c.b, nil
+			}
+			stop := p.clock.AfterFunc(wait, func() {
+				p.lk.Lock()
+				p.cond.Broadcast()
+				p.lk.Unlock()
+			})
+			p.cond.Wait()
+			stop()
+			continue
+		}
+		if p.err != nil {
+			return nil, p.err
+		}
+		p.cond.Wait()
+	}
+}
+
+// close makes pop return err once everything queued was delivered.
+func (p *pipe) close(err error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+}
+
+// reset drops everything queued, pop and push return err right away.
+func (p *pipe) reset(err error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.queue = nil
+	p.queued = 0
+	p.cond.Broadcast()
+}
+
+type stream struct {
+	network.Stream
+	out, in *pipe
+	buf     []byte // rest of the chunk being read
+}
+
+// Wrap applies c to both directions of s, so one side of a link can simulate it all.
+// Delays are measured with clock, nil uses the time package.
+// Deadlines are not supported.
+func Wrap(s network.Stream, c Conditions, clock Clock) network.Stream {
+	if clock == nil {
+		clock = realClock{}
+	}
+	w := &stream{Stream: s, out: newPipe(c, clock), in: newPipe(c, clock)}
+	go w.writeLoop()
+	go w.readLoop()
+	return w
+}
+
+func (s *stream) writeLoop() {
+	for {
+		b, err := s.out.pop()
+		if err != nil {
+			if err == errClosed {
+				s.Stream.CloseWrite()
+			}
+			return
+		}
+		if _, err := s.Stream.Write(b); err != nil {
+			s.out.reset(err)
+			return
+		}
+	}
+}
+
+func (s *stream) readLoop() {
+	for {
+		b := make([]byte, 4096)
+		n, err := s.Stream.Read(b)
+		if n > 0 {
+			if s.in.push(b[:n]) != nil {
+				return
+			}
+		}
+		if err != nil {
+			s.in.close(err)
+			return
+		}
+	}
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	if err := s.out.push(bytes.Clone(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	if len(s.buf) == 0 {
+		var err error
+		s.buf, err = s.in.pop()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// CloseWrite closes the underlying stream for writing once everything queued was delivered.
+func (s *stream) CloseWrite() error {
+	s.out.close(errClosed)
+	return nil
+}
+
+func (s *stream) CloseRead() error {
+	s.in.reset(io.EOF)
+	return s.Stream.CloseRead()
+}
+
+func (s *stream) Close() error {
+	s.CloseRead()
+	return s.CloseWrite()
+}
+
+func (s *stream) Reset() error {
+	s.out.reset(network.ErrReset)
+	s.in.reset(network.ErrReset)
+	return s.Stream.Reset()
+}
@@ -0,0 +1,177 @@
+package netsim
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Jorropo/OpenAirways/internal/manualclock"
+	"github.com/libp2p/go-libp2p/core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func TestParse(t *testing.T) {
+	const spec = "delay=50ms,jitter=10ms,dist=normal,loss=0.01,late=0.05,bandwidth=64000,stall=2s/30s"
+	c, err := Parse(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Conditions{
+		Delay:        50 * time.Millisecond,
+		Jitter:       10 * time.Millisecond,
+		Distribution: Normal,
+		Loss:         .01,
+		Late:         .05,
+		Bandwidth:    64000,
+		StallFor:     2 * time.Second,
+		StallEvery:   30 * time.Second,
+	}
+	if c != want {
+		t.Fatalf("expected %+v; got %+v", want, c)
+	}
+	if c.String() != spec {
+		t.Fatalf("expected String to round trip; got %q", c.String())
+	}
+
+	for _, bad := range []string{"delay", "delay=fast", "loss=2", "stall=2s", "stall=2s/1s", "jitter=-1ms", "colour=blue"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// streamPair returns both ends of a stream, a is wrapped with c.
+func streamPair(t *testing.T, c Conditions) (a, b network.Stream) {
+	t.Helper()
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	ha, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan network.Stream, 1)
+	hb.SetStreamHandler("/test", func(s network.Stream) { accepted <- s })
+	s, err := ha.NewStream(context.Background(), hb.ID(), "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = Wrap(s, c, nil)
+	t.Cleanup(func() { a.Reset() })
+	if _, err := a.Write([]byte{0}); err != nil { // the handler only runs once something is written
+		t.Fatal(err)
+	}
+	b = <-accepted
+	if _, err := io.ReadFull(b, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func TestDelayKeepsOrder(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	a, b := streamPair(t, Conditions{Delay: delay, Jitter: 30 * time.Millisecond, Late: .5, Loss: .1})
+
+	const count = 100
+	start := time.Now()
+	go func() {
+		for i := range count {
+			a.Write([]byte{byte(i)})
+		}
+	}()
+	var got [1]byte
+	for i := range count {
+		if _, err := io.ReadFull(b, got[:]); err != nil {
+			t.Fatal(err)
+		}
+		if got[0] != byte(i) {
+			t.Fatalf("expected byte %d; got %d", i, got[0])
+		}
+		if i == 0 && time.Since(start) < delay {
+			t.Fatalf("first byte arrived after %v, before the delay", time.Since(start))
+		}
+	}
+
+	// the other direction is delayed too.
+	start = time.Now()
+	if _, err := b.Write([]byte{42}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(a, got[:]); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < delay {
+		t.Fatalf("read arrived after %v, before the delay", time.Since(start))
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	const bandwidth = 10000
+	a, b := streamPair(t, Conditions{Bandwidth: bandwidth})
+
+	start := time.Now()
+	go a.Write(make([]byte, bandwidth/4))
+	if _, err := io.ReadFull(b, make([]byte, bandwidth/4)); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < time.Second/4 {
+		t.Fatalf("%d bytes at %dB/s took %v", bandwidth/4, bandwidth, took)
+	}
+}
+
+func TestStall(t *testing.T) {
+	p := newPipe(Conditions{StallFor: 100 * time.Millisecond, StallEvery: time.Second}, realClock{})
+	at := func(d time.Duration) time.Time { return p.epoch.Add(d) }
+	for _, tc := range []struct{ due, want time.Duration }{
+		{0, 0},
+		{899 * time.Millisecond, 899 * time.Millisecond},
+		{900 * time.Millisecond, time.Second},
+		{950 * time.Millisecond, time.Second},
+		{time.Second, time.Second},
+		{2*time.Second + 950*time.Millisecond, 3 * time.Second},
+	} {
+		if got := p.afterStalls(at(tc.due)); !got.Equal(at(tc.want)) {
+			t.Errorf("due at %v: expected delivery at %v; got %v", tc.due, tc.want, got.Sub(p.epoch))
+		}
+	}
+}
+
+func TestClock(t *testing.T) {
+	clock := manualclock.New()
+	p := newPipe(Conditions{Delay: time.Hour}, clock)
+	if err := p.push([]byte{42}); err != nil {
+		t.Fatal(err)
+	}
+	popped := make(chan []byte)
+	go func() {
+		b, _ := p.pop()
+		popped <- b
+	}()
+
+	clock.BlockUntilTimers(1)
+	clock.Advance(time.Hour - 1)
+	select {
+	case <-popped:
+		t.Fatal("delivered before the delay passed on the clock")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(1)
+	select {
+	case b := <-popped:
+		if len(b) != 1 || b[0] != 42 {
+			t.Fatalf("expected [42]; got %v", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not delivered once the delay passed on the clock")
+	}
+}
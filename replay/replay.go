@@ -0,0 +1,292 @@
+// Package replay implements the on disk format of recorded games.
+//
+// Because the simulation is deterministic, a replay only needs the commited state at the time recording started and
+// every reliable command in commit order.
+//
+// The header is:
+//   - magic "OAWR"
+//   - uvarint format version
+//   - metadata, each string being uvarint length prefixed: game version, map
+//   - initial commited state in [state.State] wire format
+//
+// Then records follow until EOF, each starting with a record kind byte:
+//   - recordTicks: uvarint n, commit moved forward n ticks
+//   - recordCommand: uvarint player id, command bytes (sized by their opcode), applied on top of the current tick
+//   - recordPlayerJoined: uvarint player id, uvarint length prefixed peer id
+//   - recordPlayerLeft: uvarint player id
+package replay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+	"github.com/Jorropo/OpenAirways/state"
+)
+
+const magic = "OAWR"
+
+// Version is the version of the file format written by [Recorder].
+const Version = 4
+
+type recordKind byte
+
+const (
+	recordTicks recordKind = iota
+	recordCommand
+	recordPlayerJoined
+	recordPlayerLeft
+)
+
+// maxStringSize bounds metadata strings so a corrupted length does not make us allocate gigabytes.
+const maxStringSize = 1 << 16
+
+type Metadata struct {
+	Version string // version of the game that recorded this, currently the netcode protocol id
+	Map     string
+}
+
+type Player struct {
+	ID   uint32
+	Peer string // libp2p peer id, empty for the host.
+}
+
+// Recorder encodes a replay in memory.
+// It does not do any IO so it can be used while holding locks, [Recorder.Take] gives back the encoded bytes.
+// It is not safe for concurrent use.
+type Recorder struct {
+	b     []byte
+	ticks uint64 // pending ticks not yet encoded, this allows to coalesce runs of empty ticks
+}
+
+// NewRecorder starts a new replay, initial is the commited state the replay starts from.
+func NewRecorder(meta Metadata, initial *state.State) *Recorder {
+	b := append([]byte(nil), magic...)
+	b = binary.AppendUvarint(b, Version)
+	b = appendString(b, meta.Version)
+	b = appendString(b, meta.Map)
+	b = initial.AppendMarshalBinary(b)
+	return &Recorder{b: b}
+}
+
+// Command records a reliable command from player being commited on the current tick.
+func (r *Recorder) Command(player uint32, c rpcgame.Command) {
+	r.flushTicks()
+	r.b = append(r.b, byte(recordCommand))
+	r.b = binary.AppendUvarint(r.b, uint64(player))
+	r.b = append(r.b, c.Bytes()...)
+}
+
+// Tick records commit moving forward one tick.
+func (r *Recorder) Tick() {
+	r.ticks++
+}
+
+func (r *Recorder) PlayerJoined(p Player) {
+	r.flushTicks()
+	r.b = append(r.b, byte(recordPlayerJoined))
+	r.b = binary.AppendUvarint(r.b, uint64(p.ID))
+	r.b = appendString(r.b, p.Peer)
+}
+
+func (r *Recorder) PlayerLeft(id uint32) {
+	r.flushTicks()
+	r.b = append(r.b, byte(recordPlayerLeft))
+	r.b = binary.AppendUvarint(r.b, uint64(id))
+}
+
+// Take returns everything encoded since the last call to Take.
+// The returned slice is owned by the caller.
+func (r *Recorder) Take() []byte {
+	r.flushTicks()
+	b := r.b
+	r.b = nil
+	return b
+}
+
+func (r *Recorder) flushTicks() {
+	if r.ticks == 0 {
+		return
+	}
+	r.b = append(r.b, byte(recordTicks))
+	r.b = binary.AppendUvarint(r.b, r.ticks)
+	r.ticks = 0
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// Command is a commited command along with the player who sent it.
+type Command struct {
+	Player uint32
+	Op     rpcgame.Command
+}
+
+// Tick is everything that happened on one commited tick.
+type Tick struct {
+	Now      state.Time // tick the commands are applied on top of
+	Commands []Command
+	Joined   []Player
+	Left     []uint32
+}
+
+// Apply applies the tick's commands to s and ticks it.
+// s.Now must be equal to t.Now.
+func (t *Tick) Apply(s *state.State) {
+	if s.Now != t.Now {
+		panic(fmt.Sprintf("applying replay tick %d on top of state at %d", t.Now, s.Now))
+	}
+	for _, c := range t.Commands {
+		s.Apply(c.Player, c.Op)
+	}
+	s.Tick()
+}
+
+type Reader struct {
+	Meta    Metadata
+	Initial state.State
+
+	r     *bufio.Reader
+	now   state.Time
+	ticks uint64 // remaining empty ticks from the last recordTicks
+	tick  Tick
+}
+
+// NewReader reads the replay header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	rr := &Reader{r: bufio.NewReader(r)}
+
+	var m [len(magic)]byte
+	if _, err := io.ReadFull(rr.r, m[:]); err != nil {
+		return nil, fmt.Errorf("reading magic: %w", err)
+	}
+	if string(m[:]) != magic {
+		return nil, fmt.Errorf("not a replay file, got magic %q", m[:])
+	}
+	v, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return nil, fmt.Errorf("reading version: %w", err)
+	}
+	if v != Version {
+		return nil, fmt.Errorf("unsupported replay version %d, expected %d", v, Version)
+	}
+	rr.Meta.Version, err = rr.readString()
+	if err != nil {
+		return nil, fmt.Errorf("reading game version: %w", err)
+	}
+	rr.Meta.Map, err = rr.readString()
+	if err != nil {
+		return nil, fmt.Errorf("reading map: %w", err)
+	}
+	if _, err := rr.Initial.Read(rr.r); err != nil {
+		return nil, fmt.Errorf("reading initial state: %w", err)
+	}
+	rr.now = rr.Initial.Now
+	return rr, nil
+}
+
+// Next returns the next tick, it returns [io.EOF] once the end of the replay is reached.
+// Players joining or leaving after the last commited tick, like when the server stops, are returned on a final tick without commands.
+// The returned Tick is only valid until the next call to Next.
+func (r *Reader) Next() (*Tick, error) {
+	t := &r.tick
+	t.Now = r.now
+	t.Commands = t.Commands[:0]
+	t.Joined = t.Joined[:0]
+	t.Left = t.Left[:0]
+
+	for r.ticks == 0 {
+		kind, err := r.r.ReadByte()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			if len(t.Commands) != 0 {
+				return nil, io.ErrUnexpectedEOF // commands were recorded but the tick never commited
+			}
+			if len(t.Joined) == 0 && len(t.Left) == 0 {
+				return nil, io.EOF
+			}
+			r.ticks = 1 // give them back on a tick of their own
+			break
+		}
+
+		switch recordKind(kind) {
+		case recordTicks:
+			r.ticks, err = binary.ReadUvarint(r.r)
+			if err != nil {
+				return nil, fmt.Errorf("reading ticks: %w", noEOF(err))
+			}
+			if r.ticks == 0 {
+				return nil, fmt.Errorf("empty ticks record")
+			}
+		case recordCommand:
+			player, err := binary.ReadUvarint(r.r)
+			if err != nil {
+				return nil, fmt.Errorf("reading player id: %w", noEOF(err))
+			}
+			var c rpcgame.Command
+			if _, err := io.ReadFull(r.r, c[:2]); err != nil {
+				return nil, fmt.Errorf("reading opcode: %w", noEOF(err))
+			}
+			op := c.OpCode()
+			sz, ok := op.Size()
+			if !ok {
+				return nil, fmt.Errorf("invalid opcode: %v", op)
+			}
+			if _, err := io.ReadFull(r.r, c[2:sz]); err != nil {
+				return nil, fmt.Errorf("reading payload %v: %w", op, noEOF(err))
+			}
+			t.Commands = append(t.Commands, Command{Player: uint32(player), Op: c})
+		case recordPlayerJoined:
+			id, err := binary.ReadUvarint(r.r)
+			if err != nil {
+				return nil, fmt.Errorf("reading player id: %w", noEOF(err))
+			}
+			p, err := r.readString()
+			if err != nil {
+				return nil, fmt.Errorf("reading peer id: %w", err)
+			}
+			t.Joined = append(t.Joined, Player{ID: uint32(id), Peer: p})
+		case recordPlayerLeft:
+			id, err := binary.ReadUvarint(r.r)
+			if err != nil {
+				return nil, fmt.Errorf("reading player id: %w", noEOF(err))
+			}
+			t.Left = append(t.Left, uint32(id))
+		default:
+			return nil, fmt.Errorf("unknown record kind: %d", kind)
+		}
+	}
+
+	r.ticks--
+	r.now++
+	return t, nil
+}
+
+func (r *Reader) readString() (string, error) {
+	l, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return "", noEOF(err)
+	}
+	if l > maxStringSize {
+		return "", fmt.Errorf("string too long: %d", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return "", noEOF(err)
+	}
+	return string(b), nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+	"github.com/Jorropo/OpenAirways/state"
+)
+
+func newState() *state.State {
+	s := &state.State{
+		MapSize:    state.Rect{X: -960, Y: -540, W: 1920, H: 1080},
+		CameraSize: state.Rect{X: -480, Y: -270, W: 960, H: 540},
+		Runways:    []state.Runway{{ID: 0, Pos: state.V2{X: 100, Y: -50}, Heading: 1234}},
+	}
+	s.Tick()
+	return s
+}
+
+func TestRoundTrip(t *testing.T) {
+	initial := newState()
+	meta := Metadata{Version: "test", Map: "random"}
+	r := NewRecorder(meta, initial)
+	var buf bytes.Buffer
+
+	want := []Tick{
+		{Now: initial.Now, Joined: []Player{{ID: 0}, {ID: 1, Peer: "someone"}}},
+		{Now: initial.Now + 1},
+		{Now: initial.Now + 2, Commands: []Command{{1, rpcgame.EncodeGivePlaneHeading(0, 42)}, {0, rpcgame.EncodePause(10)}}},
+		{Now: initial.Now + 3, Left: []uint32{1}},
+		{Now: initial.Now + 4},
+		{Now: initial.Now + 5, Joined: []Player{{ID: 2, Peer: "late"}}, Left: []uint32{0}}, // after the last commited tick
+	}
+	for i, tick := range want {
+		for _, p := range tick.Joined {
+			r.PlayerJoined(p)
+		}
+		for _, c := range tick.Commands {
+			r.Command(c.Player, c.Op)
+		}
+		for _, id := range tick.Left {
+			r.PlayerLeft(id)
+		}
+		if i != len(want)-1 {
+			r.Tick()
+		}
+		buf.Write(r.Take()) // in pieces like the netcode does
+	}
+
+	rr, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Meta != meta {
+		t.Fatalf("expected metadata %+v; got %+v", meta, rr.Meta)
+	}
+	if got, want := rr.Initial.AppendMarshalBinary(nil), initial.AppendMarshalBinary(nil); !bytes.Equal(got, want) {
+		t.Fatal("initial state does not round trip")
+	}
+	for i, w := range want {
+		got, err := rr.Next()
+		if err != nil {
+			t.Fatalf("tick %d: %v", i, err)
+		}
+		if got.Now != w.Now || !slices.Equal(got.Commands, w.Commands) || !slices.Equal(got.Joined, w.Joined) || !slices.Equal(got.Left, w.Left) {
+			t.Fatalf("tick %d: expected %+v; got %+v", i, w, *got)
+		}
+	}
+	if _, err := rr.Next(); err != io.EOF {
+		t.Fatalf("expected EOF; got %v", err)
+	}
+}
+
+func TestTruncatedTick(t *testing.T) {
+	r := NewRecorder(Metadata{}, newState())
+	r.Command(0, rpcgame.EncodeGivePlaneHeading(0, 42)) // never commited
+	rr, err := NewReader(bytes.NewReader(r.Take()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rr.Next(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected ErrUnexpectedEOF; got %v", err)
+	}
+}
+
+// TestDeterminism records a game and replays it from Initial, it must end on the same state.
+func TestDeterminism(t *testing.T) {
+	s := newState()
+	r := NewRecorder(Metadata{}, s)
+	var buf bytes.Buffer
+	for i := range state.TickRate * 12 { // long enough for planes to spawn
+		if len(s.Planes) != 0 && i%state.TickRate == 0 {
+			c := rpcgame.EncodeGivePlaneHeading(s.Planes[i%len(s.Planes)].ID, rpcgame.Rot16(i*997))
+			s.Apply(1, c)
+			r.Command(1, c)
+		}
+		s.Tick()
+		r.Tick()
+		if i%100 == 0 {
+			buf.Write(r.Take())
+		}
+	}
+	buf.Write(r.Take())
+
+	rr, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := new(state.State)
+	replayed.Copy(&rr.Initial)
+	for {
+		tick, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tick.Apply(replayed)
+	}
+	if len(s.Planes) == 0 {
+		t.Fatal("expected planes to spawn during the game")
+	}
+	if got, want := replayed.AppendMarshalBinary(nil), s.AppendMarshalBinary(nil); !bytes.Equal(got, want) {
+		t.Fatalf("replay diverged: at %d; expected at %d", replayed.Now, s.Now)
+	}
+}
@@ -2,6 +2,7 @@ package rollback
 
 import (
 	"bytes"
+	"math/bits"
 	"slices"
 
 	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
@@ -10,29 +11,94 @@ import (
 
 type Command struct {
 	Op        rpcgame.Command
-	Reliable  bool // if reliable == false then we will discard it on commit
+	Player    uint32 // who sent it, the server stamps it on everything it relays
+	Reliable  bool   // if reliable == false then we will discard it on commit or past the horizon, unless it is promoted by a reliable duplicate
 	HappendAt state.Time
 }
 
 type futureTicks struct {
 	commited uint      // tracks how many players commited this tick
-	cmds     []command // sorted by their rpcgame.Command representation
+	cmds     []command // sorted by [command.compare]
 }
 
 type command struct {
 	Op       rpcgame.Command
+	Player   uint32
 	Reliable bool // if reliable == false then we will discard it on commit
 }
 
+// compare orders commands in a tick by player then by their rpcgame.Command representation, this order is how they are applied so it must be deterministic.
+// The same command from two players is not a duplicate.
+func (c command) compare(player uint32, op rpcgame.Command) int {
+	if c.Player != player {
+		if c.Player < player {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(c.Op[:], op[:])
+}
+
 type Rollback struct {
 	// FIXME: netcode is tightly coupled with this struct, merge the two ?
 
 	Commit, Live state.State
 	LiveGen      uint64 // because after a rollback live might change but have the same tickid we track modifications in LiveGen
 
+	// UnreliableHorizon is how many ticks behind Live an unreliable command can stay in the join buffer without being promoted to reliable.
+	// Zero keeps them until commit.
+	UnreliableHorizon state.Time
+	// OnDiscard is called when an unreliable command is thrown away without ever having been promoted to reliable.
+	// It is called synchronously from [Rollback.TickLive] and [Rollback.TickCommit].
+	OnDiscard func(Command)
+
 	// TODO: replace with a MaxOutOfTime sized ring buffer
 	// index into []futureTicks + Commit.Now gives tick id to be applied on top of.
 	join [][]command
+
+	stats Stats
+}
+
+// Stats are counters about the rollback buffer, they only ever increase.
+type Stats struct {
+	Rollbacks     uint64    // how many times [Rollback.Do] could not apply on top of Live and had to replay from Commit
+	ReplayedTicks uint64    // total ticks replayed by rollbacks
+	ReplayLength  Histogram // ticks replayed per rollback
+	Duplicates    uint64    // commands given to [Rollback.Do] that were already in the join buffer
+	// UnreliableDiscarded counts unreliable commands thrown away at commit or horizon because they never arrived reliably.
+	UnreliableDiscarded uint64
+	UnreliableExpired   uint64    // unreliable commands given to [Rollback.Do] that were already past the horizon
+	JoinDepth           Histogram // Live.Now - Commit.Now, sampled every time Live or Commit tick
+
+	// Distance is the current Live.Now - Commit.Now, it is not a counter.
+	Distance state.Time
+	// JoinLength is how many ticks are currently held in the join buffer, it is not a counter.
+	// It can be bigger than Distance when commands are received for ticks in the future of Live.
+	JoinLength uint64
+}
+
+// Histogram counts values in power of two buckets.
+// Bucket i counts values v such that bits.Len64(v) == i, so bucket 0 is 0, bucket 1 is 1, bucket 2 is 2-3, bucket 3 is 4-7, ...
+type Histogram [65]uint64
+
+func (h *Histogram) Add(v uint64) {
+	h[bits.Len64(v)]++
+}
+
+// Count returns the number of values added.
+func (h *Histogram) Count() (c uint64) {
+	for _, v := range h {
+		c += v
+	}
+	return c
+}
+
+// Stats returns a snapshot of the counters.
+func (r *Rollback) Stats() Stats {
+	s := r.stats
+	s.Distance = r.Live.Now - r.Commit.Now
+	s.JoinLength = uint64(len(r.join))
+	return s
 }
 
 // Joins iterate all the jointures (rollback buffer) between Commit and Live.
@@ -40,7 +106,7 @@ func (r *Rollback) Joins(yield func(Command) bool) {
 	base := r.Commit.Now
 	for i, ft := range r.join {
 		for _, c := range ft {
-			if !yield(Command{Op: c.Op, Reliable: c.Reliable, HappendAt: state.Time(i) + base}) {
+			if !yield(Command{Op: c.Op, Player: c.Player, Reliable: c.Reliable, HappendAt: state.Time(i) + base}) {
 				return
 			}
 		}
@@ -62,46 +128,73 @@ func (r *Rollback) Do(cmd ...Command) (liveIsNew bool) {
 		if c.HappendAt <= r.Commit.Now {
 			panic("should be unreachable, netcode shouldn't let this through: giving commands before commit")
 		}
+		if !c.Reliable && r.UnreliableHorizon != 0 && c.HappendAt+r.UnreliableHorizon <= r.Live.Now {
+			r.stats.UnreliableExpired++
+			continue // too old, it would be discarded on the next tick anyway.
+		}
 		idx := r.grabIdx(c.HappendAt)
 		ft := r.join[idx]
-		i, ok := slices.BinarySearchFunc(ft, c.Op, func(a command, b rpcgame.Command) int {
-			return bytes.Compare(a.Op[:], b[:])
+		i, ok := slices.BinarySearchFunc(ft, c, func(a command, b Command) int {
+			return a.compare(b.Player, b.Op)
 		})
 		if ok {
 			ft[i].Reliable = ft[i].Reliable || c.Reliable
+			r.stats.Duplicates++
 			continue // dups, don't reapply
 		}
 		canBeAppliedOnTopOfLive = canBeAppliedOnTopOfLive && i == len(ft) && c.HappendAt == r.Live.Now
 		if canBeAppliedOnTopOfLive {
-			r.Live.Apply(c.Op)
+			r.Live.Apply(c.Player, c.Op)
 		}
-		r.join[idx] = slices.Insert(ft, i, command{c.Op, c.Reliable})
+		r.join[idx] = slices.Insert(ft, i, command{c.Op, c.Player, c.Reliable})
 		liveIsNew = true
 	}
-	if liveIsNew {
-		if canBeAppliedOnTopOfLive {
-			return
+	if liveIsNew && !canBeAppliedOnTopOfLive {
+		r.replay() // replay with the new commands
+	}
+	return
+}
+
+// replay throws away Live and recreate it from Commit and the join buffer.
+func (r *Rollback) replay() {
+	tgt := r.Live.Now
+	replayed := uint64(tgt - r.Commit.Now)
+	r.stats.Rollbacks++
+	r.stats.ReplayedTicks += replayed
+	r.stats.ReplayLength.Add(replayed)
+	r.Live.Copy(&r.Commit)
+	r.LiveGen++
+	if l(r.join) > 0 {
+		for _, c := range r.join[0] {
+			r.Live.Apply(c.Player, c.Op)
 		}
-		// replay with the new commands
-		tgt := r.Live.Now
-		r.Live.Copy(&r.Commit)
-		r.LiveGen++
-		if l(r.join) > 0 {
-			for _, c := range r.join[0] {
-				r.Live.Apply(c.Op)
-			}
+	}
+	for tgt > r.Live.Now {
+		r.Live.Tick()
+		idx := uint(r.Live.Now - r.Commit.Now)
+		if idx >= l(r.join) {
+			continue
 		}
-		for tgt > r.Live.Now {
-			r.Live.Tick()
-			idx := uint(r.Live.Now - r.Commit.Now)
-			if idx >= l(r.join) {
-				continue
-			}
-			for _, c := range r.join[idx] {
-				r.Live.Apply(c.Op)
-			}
+		for _, c := range r.join[idx] {
+			r.Live.Apply(c.Player, c.Op)
 		}
 	}
+}
+
+// discardUnreliable removes the unreliable commands from r.join[idx] and returns true if any were removed.
+func (r *Rollback) discardUnreliable(idx uint) (removed bool) {
+	when := r.Commit.Now + state.Time(idx)
+	r.join[idx] = slices.DeleteFunc(r.join[idx], func(c command) bool {
+		if c.Reliable {
+			return false
+		}
+		r.stats.UnreliableDiscarded++
+		if r.OnDiscard != nil {
+			r.OnDiscard(Command{Op: c.Op, Player: c.Player, Reliable: false, HappendAt: when})
+		}
+		removed = true
+		return true
+	})
 	return
 }
 
@@ -113,15 +206,17 @@ func (r *Rollback) TickCommit() {
 	if idx != 0 {
 		panic("should be unreachable, netcode shouldn't let this through: trying to commit out of order")
 	}
+	discarded := r.discardUnreliable(0)
 	for _, c := range r.join[0] {
-		if !c.Reliable {
-			continue // discard unreliable commands
-		}
-		r.Commit.Apply(c.Op)
+		r.Commit.Apply(c.Player, c.Op)
 	}
 	r.Commit.Tick()
 	r.join[0] = nil // early gc
 	r.join = r.join[1:]
+	r.stats.JoinDepth.Add(uint64(r.Live.Now - r.Commit.Now))
+	if discarded {
+		r.replay() // they were already applied to Live, remove them from history.
+	}
 }
 
 func (r *Rollback) TickLive() {
@@ -131,14 +226,30 @@ func (r *Rollback) TickLive() {
 	r.Live.Tick()
 	r.LiveGen++
 	idx := uint(r.Live.Now - r.Commit.Now)
-	if idx >= l(r.join) {
-		return
+	r.stats.JoinDepth.Add(uint64(idx))
+	if idx < l(r.join) {
+		for _, c := range r.join[idx] {
+			r.Live.Apply(c.Player, c.Op)
+		}
 	}
-	for _, c := range r.join[idx] {
-		r.Live.Apply(c.Op)
+
+	if r.UnreliableHorizon != 0 && r.Live.Now-r.Commit.Now >= r.UnreliableHorizon {
+		expired := uint(r.Live.Now - r.UnreliableHorizon - r.Commit.Now)
+		if expired < l(r.join) && r.discardUnreliable(expired) {
+			r.replay() // they were already applied to Live, remove them from history.
+		}
 	}
 }
 
+// Reset throws away the join buffer and restarts from commit, Live is set to a copy of it.
+// The configuration and stats are kept.
+func (r *Rollback) Reset(commit *state.State) {
+	r.Commit.Copy(commit)
+	r.Live.Copy(commit)
+	r.LiveGen++
+	r.join = nil
+}
+
 // check does sanity checks for correctness
 func (r *Rollback) check() {
 	if r.Commit.Now >= r.Live.Now {
@@ -0,0 +1,203 @@
+package rollback
+
+import (
+	"bytes"
+	"cmp"
+	mrand "math/rand/v2"
+	"slices"
+	"testing"
+
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+	"github.com/Jorropo/OpenAirways/state"
+)
+
+// timeline is a randomly generated game, every command is delivered to [Rollback.Do] at some point in live time.
+type timeline struct {
+	ticks   state.Time // all commands happen at or before this tick
+	lag     state.Time // how far Commit trails behind Live
+	horizon state.Time
+	events  []event // sorted by arrival
+
+	// reliable is the set of commands that were sent reliably, it is the ground truth.
+	reliable map[Command]struct{}
+}
+
+type event struct {
+	arriveAt state.Time // Live.Now when the command is given to Do
+	cmd      Command
+}
+
+// planeSpawnEvery mirrors the testing traffic generated by [state.State.Tick].
+const planeSpawnEvery = state.TickRate * 5
+
+func genTimeline(rng *mrand.Rand, lag, horizon state.Time) *timeline {
+	t := &timeline{
+		ticks:    state.Time(planeSpawnEvery + rng.IntN(3*planeSpawnEvery)),
+		lag:      lag,
+		horizon:  horizon,
+		reliable: make(map[Command]struct{}),
+	}
+
+	// arrival computes a random arrival time such that the command is never before Commit when delivered.
+	// It can be before happening to simulate peers running ahead of us.
+	arrival := func(happend state.Time) state.Time {
+		delay := rng.IntN(int(lag)+int(lag)/2) - int(lag)/2
+		return state.Time(max(1, int(happend)+delay))
+	}
+
+	n := 1 + rng.IntN(int(t.ticks)/4)
+	for range n {
+		happend := state.Time(1 + rng.IntN(int(t.ticks)))
+		planes := min(2, 1+int(happend-1)/planeSpawnEvery) // don't give orders to planes that do not exist yet
+		c := Command{
+			Op:        rpcgame.EncodeGivePlaneHeading(uint32(rng.IntN(planes)), rpcgame.Rot16(rng.Uint32())),
+			Player:    uint32(rng.IntN(3)),
+			HappendAt: happend,
+		}
+
+		switch rng.IntN(4) {
+		case 0:
+			// unreliable only, it must be discarded
+			t.events = append(t.events, event{arrival(happend), c})
+		case 1:
+			// unreliable fast path then promoted by the reliable one
+			t.events = append(t.events, event{arrival(happend), c})
+			c.Reliable = true
+			t.events = append(t.events, event{arrival(happend), c})
+			t.reliable[c] = struct{}{}
+		default:
+			c.Reliable = true
+			t.events = append(t.events, event{arrival(happend), c})
+			t.reliable[c] = struct{}{}
+		}
+		if rng.IntN(4) == 0 {
+			// duplicate
+			t.events = append(t.events, event{arrival(happend), c})
+		}
+	}
+
+	rng.Shuffle(len(t.events), func(i, j int) { t.events[i], t.events[j] = t.events[j], t.events[i] })
+	slices.SortStableFunc(t.events, func(a, b event) int { return cmp.Compare(a.arriveAt, b.arriveAt) })
+	return t
+}
+
+func initialState() state.State {
+	return state.State{
+		MapSize:    state.Rect{X: -960, Y: -540, W: 1920, H: 1080},
+		CameraSize: state.Rect{X: -480, Y: -270, W: 960, H: 540},
+		Runways:    []state.Runway{{ID: 0, Pos: state.V2{X: 12, Y: -34}, Heading: 1234}},
+	}
+}
+
+// reference advances s by one tick in a straight line, without any rollback.
+func (t *timeline) reference(s *state.State) {
+	var cmds []Command
+	for c := range t.reliable {
+		if c.HappendAt == s.Now {
+			cmds = append(cmds, c)
+		}
+	}
+	slices.SortFunc(cmds, func(a, b Command) int {
+		if c := cmp.Compare(a.Player, b.Player); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.Op[:], b.Op[:])
+	})
+	for _, c := range cmds {
+		s.Apply(c.Player, c.Op)
+	}
+	s.Tick()
+}
+
+func (t *timeline) run(tb testing.TB, rng *mrand.Rand) {
+	tb.Helper()
+
+	var r Rollback
+	r.UnreliableHorizon = t.horizon
+	var discarded []Command
+	r.OnDiscard = func(c Command) {
+		discarded = append(discarded, c)
+	}
+	r.Commit = initialState()
+	r.Live.Copy(&r.Commit)
+	r.Live.Tick()
+
+	ref := initialState()
+	checkCommit := func() {
+		tb.Helper()
+		for ref.Now < r.Commit.Now {
+			t.reference(&ref)
+		}
+		if got, expected := r.Commit.AppendMarshalBinary(nil), ref.AppendMarshalBinary(nil); !bytes.Equal(got, expected) {
+			tb.Fatalf("commit diverged at tick %d:\ngot:      %x\nexpected: %x", r.Commit.Now, got, expected)
+		}
+	}
+
+	events := t.events
+	end := t.ticks + t.lag + 1
+	for r.Live.Now <= end {
+		var batch []Command
+		for len(events) > 0 && events[0].arriveAt <= r.Live.Now {
+			batch = append(batch, events[0].cmd)
+			events = events[1:]
+		}
+		// deliver in random sized batches to exercise both the one by one and variadic paths.
+		for len(batch) > 0 {
+			k := 1 + rng.IntN(len(batch))
+			r.Do(batch[:k]...)
+			batch = batch[k:]
+		}
+
+		r.TickLive()
+		for r.Live.Now-r.Commit.Now > t.lag {
+			r.TickCommit()
+			checkCommit()
+		}
+	}
+	for r.Commit.Now+1 < r.Live.Now {
+		r.TickCommit()
+		checkCommit()
+	}
+	if len(events) != 0 {
+		tb.Fatalf("%d events were never delivered", len(events))
+	}
+
+	for ref.Now < r.Live.Now {
+		t.reference(&ref)
+	}
+	if got, expected := r.Live.AppendMarshalBinary(nil), ref.AppendMarshalBinary(nil); !bytes.Equal(got, expected) {
+		tb.Fatalf("live diverged at tick %d:\ngot:      %x\nexpected: %x", r.Live.Now, got, expected)
+	}
+
+	if t.horizon == 0 {
+		for _, c := range discarded {
+			c.Reliable = true
+			if _, ok := t.reliable[c]; ok {
+				tb.Fatalf("discarded a command that was received reliably: %#v", c)
+			}
+		}
+	}
+}
+
+func TestDeterminism(t *testing.T) {
+	for seed := range uint64(64) {
+		rng := mrand.New(mrand.NewPCG(seed, seed))
+		lag := state.Time(1 + rng.IntN(state.TickRate))
+		var horizon state.Time
+		if seed%2 == 1 {
+			horizon = state.Time(1 + rng.IntN(int(lag)))
+		}
+		genTimeline(rng, lag, horizon).run(t, rng)
+	}
+}
+
+func FuzzDeterminism(f *testing.F) {
+	f.Add(uint64(0), uint8(1), uint8(0))
+	f.Add(uint64(1), uint8(10), uint8(0))
+	f.Add(uint64(2), uint8(60), uint8(5))
+	f.Add(uint64(3), uint8(255), uint8(255))
+	f.Fuzz(func(t *testing.T, seed uint64, lag, horizon uint8) {
+		rng := mrand.New(mrand.NewPCG(seed, uint64(lag)<<8|uint64(horizon)))
+		genTimeline(rng, 1+state.Time(lag), state.Time(horizon)).run(t, rng)
+	})
+}
@@ -1,18 +1,25 @@
-// TODO: add parsing and validation in this package
+// Package rpcgame is the wire encoding of the game and meta commands exchanged between zig, go clients and the go server, see RPC.md.
 package rpcgame
 
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
+	"slices"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
-// maximumSize is the size, in bytes of the largest packet sent from the client
-// to the server.
+// maximumSize is the size, in bytes of the largest packet sent between go
+// peers, without the payload of variably sized ones.
 //
-// Currently, it is GivePlaneHeading
-const maximumSize = 2 + 6
+// Currently, it is Handoff
+const maximumSize = 2 + 8
+
+// MaxNameSize is how many bytes a player name can take.
+const MaxNameSize = 16
 
 type Command [maximumSize]byte
 
@@ -31,39 +38,199 @@ func (c *Command) OpCode() OpCode {
 	return OpCode(binary.LittleEndian.Uint16(c[:]))
 }
 
+// PayloadSize returns how many bytes follow c on the wire for variably sized opcodes, it is zero for the others.
+// c only holds the fixed part of variably sized commands, it ends with the payload's length.
+func (c *Command) PayloadSize() uint {
+	switch c.OpCode() {
+	case SetName:
+		return uint(c[2])
+	case Chat:
+		return uint(c[3])
+	case RosterUpdate, ChatMessage:
+		return uint(c[7])
+	default:
+		return 0
+	}
+}
+
 type OpCode uint16
 
 // client to server (0x0000 <= n < 0x0800)
 const (
 	_ OpCode = iota
 	GivePlaneHeading
+	Pause
+	Resume
+	Handoff
+	SetController
 )
 
 func (o OpCode) String() string {
 	switch o {
 	case GivePlaneHeading:
 		return "GivePlaneHeading"
+	case Pause:
+		return "Pause"
+	case Resume:
+		return "Resume"
+	case Handoff:
+		return "Handoff"
+	case SetController:
+		return "SetController"
 	case CommitTick:
 		return "CommitTick"
+	case SetName:
+		return "SetName"
+	case SetReady:
+		return "SetReady"
+	case Chat:
+		return "Chat"
+	case ClientHeartbeat:
+		return "ClientHeartbeat"
+	case ClientPing:
+		return "ClientPing"
+	case ClientPong:
+		return "ClientPong"
+	case Leave:
+		return "Leave"
+	case Mispredicted:
+		return "Mispredicted"
+	case Reconnecting:
+		return "Reconnecting"
+	case RosterJoin:
+		return "RosterJoin"
+	case RosterLeave:
+		return "RosterLeave"
+	case RosterUpdate:
+		return "RosterUpdate"
+	case GameStart:
+		return "GameStart"
+	case ChatMessage:
+		return "ChatMessage"
+	case Kicked:
+		return "Kicked"
+	case HostLeaving:
+		return "HostLeaving"
+	case ServerHeartbeat:
+		return "ServerHeartbeat"
+	case ServerPing:
+		return "ServerPing"
+	case ServerPong:
+		return "ServerPong"
+	case Lead:
+		return "Lead"
+	case LiveTick:
+		return "LiveTick"
 	default:
 		return "OpCode(" + strconv.FormatUint(uint64(o), 10) + ")"
 	}
 }
 
 // Size returns the size of the command in bytes including the opcode.
-//
-// FIXME: rework this when variably sized opcodes are added.
+// For variably sized opcodes it is the size of the fixed part, see [Command.PayloadSize].
 func (o OpCode) Size() (size uint, exists bool) {
 	switch o {
 	case GivePlaneHeading:
 		return 8, true // opcode: u16, id: u32, heading: Rot16
-	case CommitTick:
+	case Pause:
+		return 6, true // opcode: u16, at: u32
+	case Resume:
+		return 6, true // opcode: u16, delay: u32
+	case Handoff:
+		return 10, true // opcode: u16, id: u32, player: u32
+	case SetController:
+		return 7, true // opcode: u16, player: u32, on: u8
+	case CommitTick, ClientHeartbeat, ServerHeartbeat, Leave, HostLeaving:
 		return 2, true // opcode: u16
+	case ClientPing, ClientPong, ServerPing, ServerPong:
+		return 6, true // opcode: u16, seq: u32
+	case Lead:
+		return 6, true // opcode: u16, ticks: u32
+	case LiveTick:
+		return 6, true // opcode: u16, tick: u32
+	case SetName:
+		return 3, true // opcode: u16, length: u8
+	case SetReady:
+		return 3, true // opcode: u16, ready: u8
+	case RosterJoin, RosterLeave:
+		return 6, true // opcode: u16, player: u32
+	case RosterUpdate:
+		return 8, true // opcode: u16, player: u32, ready: u8, length: u8
+	case GameStart:
+		return 2, true // opcode: u16
+	case Chat:
+		return 4, true // opcode: u16, callout: u8, length: u8
+	case ChatMessage:
+		return 8, true // opcode: u16, player: u32, callout: u8, length: u8
+	case Kicked:
+		return 3, true // opcode: u16, banned: u8
 	default:
 		return 0, false
 	}
 }
 
+// Namespace is the set of opcodes allowed in one direction of a connection.
+// It only checks opcodes and sizes, validation which depends on the game state lives in [state.State.Validate].
+type Namespace struct {
+	name string
+	ops  []OpCode
+}
+
+var (
+	// FromFrontend are the opcodes zig can send to go.
+	FromFrontend = Namespace{"frontend to go", []OpCode{GivePlaneHeading, Pause, Resume, Handoff, SetName, SetReady, Chat}}
+	// ClientToServer are the opcodes clients can send to the server over multiplayer.
+	ClientToServer = Namespace{"client to server", []OpCode{GivePlaneHeading, Pause, Resume, Handoff, SetName, SetReady, Chat, CommitTick, ClientHeartbeat, ClientPing, ClientPong, Leave}}
+	// ServerToClient are the opcodes the server can relay to clients over multiplayer.
+	ServerToClient = Namespace{"server to client", []OpCode{GivePlaneHeading, Pause, Resume, Handoff, SetController, RosterJoin, RosterLeave, RosterUpdate, GameStart, ChatMessage, Kicked, HostLeaving, CommitTick, ServerHeartbeat, ServerPing, ServerPong, Lead, LiveTick}}
+	// SpectatorToServer are the opcodes spectators can send to the server, they only keep the connection alive and say when they leave.
+	SpectatorToServer = Namespace{"spectator to server", []OpCode{ClientHeartbeat, ClientPing, ClientPong, Leave}}
+	// Mesh are the opcodes players can send each other over the unreliable mesh.
+	Mesh = Namespace{"over the mesh", []OpCode{GivePlaneHeading}}
+)
+
+func (ns Namespace) String() string {
+	return ns.name
+}
+
+// Allows returns true if op can be sent in this direction.
+func (ns Namespace) Allows(op OpCode) bool {
+	return slices.Contains(ns.ops, op)
+}
+
+// Read reads one command from r and errors if it is not allowed in ns.
+// Bytes past the command's size are zeroed so commands can be compared.
+// The payload of variably sized commands must be read with [ReadPayload].
+// Game commands must still be checked with [state.State.Validate] before they are applied.
+func (ns Namespace) Read(r io.Reader, c *Command) error {
+	*c = Command{}
+	if _, err := io.ReadFull(r, c[:2]); err != nil {
+		return fmt.Errorf("reading opcode: %w", err)
+	}
+	op := c.OpCode()
+	if !ns.Allows(op) {
+		return fmt.Errorf("opcode %v is not allowed %v", op, ns)
+	}
+	sz, _ := op.Size()
+	if _, err := io.ReadFull(r, c[2:sz]); err != nil {
+		return fmt.Errorf("reading payload %v: %w", op, err)
+	}
+	return nil
+}
+
+// ReadPayload reads the payload following c, it returns nil if c has none.
+func ReadPayload(r io.Reader, c *Command) ([]byte, error) {
+	n := c.PayloadSize()
+	if n == 0 {
+		return nil, nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("reading %v payload: %w", c.OpCode(), err)
+	}
+	return b, nil
+}
+
 // server to client (0x0800 <= n < 0x1000)
 const (
 	GameInit OpCode = iota + 0x0800
@@ -71,6 +238,35 @@ const (
 	MapResize
 )
 
+// meta client to server (0x1000 <= n < 0x1800)
+const (
+	SetName OpCode = iota + 0x1000
+	SetReady
+	Chat
+	ClientHeartbeat
+	ClientPing
+	ClientPong
+	Leave
+)
+
+// meta server to client (0x1800 <= n < 0x2000)
+const (
+	Mispredicted OpCode = iota + 0x1800
+	Reconnecting
+	RosterJoin
+	RosterLeave
+	RosterUpdate
+	GameStart
+	ChatMessage
+	Kicked
+	HostLeaving
+	ServerHeartbeat
+	ServerPing
+	ServerPong
+	Lead
+	LiveTick
+)
+
 // local meta
 const (
 	CommitTick OpCode = iota + 0x2000
@@ -84,6 +280,42 @@ func EncodeGivePlaneHeading(id uint32, heading Rot16) Command {
 	return c
 }
 
+// EncodePause freezes the game once it reaches tick at.
+func EncodePause(at uint32) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(Pause))
+	binary.LittleEndian.PutUint32(c[2:], at)
+	return c
+}
+
+// EncodeResume unfreezes the game, everyone starts ticking again delay ticks worth of time after the server got it.
+func EncodeResume(delay uint32) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(Resume))
+	binary.LittleEndian.PutUint32(c[2:], delay)
+	return c
+}
+
+// EncodeHandoff gives the plane with this id to player, only it's current owner can do it.
+func EncodeHandoff(id, player uint32) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(Handoff))
+	binary.LittleEndian.PutUint32(c[2:], id)
+	binary.LittleEndian.PutUint32(c[6:], player)
+	return c
+}
+
+// EncodeSetController adds or removes player from the players planes are split between, only the host sends it.
+func EncodeSetController(player uint32, on bool) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(SetController))
+	binary.LittleEndian.PutUint32(c[2:], player)
+	if on {
+		c[6] = 1
+	}
+	return c
+}
+
 // Tau is one full turn as a Rot16
 const Tau = 1 << 16
 
@@ -98,3 +330,182 @@ func EncodeCommitTick() Command {
 	binary.LittleEndian.PutUint16(c[:], uint16(CommitTick))
 	return c
 }
+
+func EncodeClientHeartbeat() Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(ClientHeartbeat))
+	return c
+}
+
+func EncodeClientPing(seq uint32) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(ClientPing))
+	binary.LittleEndian.PutUint32(c[2:], seq)
+	return c
+}
+
+func EncodeClientPong(seq uint32) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(ClientPong))
+	binary.LittleEndian.PutUint32(c[2:], seq)
+	return c
+}
+
+func EncodeServerHeartbeat() Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(ServerHeartbeat))
+	return c
+}
+
+func EncodeServerPing(seq uint32) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(ServerPing))
+	binary.LittleEndian.PutUint32(c[2:], seq)
+	return c
+}
+
+func EncodeServerPong(seq uint32) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(ServerPong))
+	binary.LittleEndian.PutUint32(c[2:], seq)
+	return c
+}
+
+func EncodeLead(ticks uint32) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(Lead))
+	binary.LittleEndian.PutUint32(c[2:], ticks)
+	return c
+}
+
+func EncodeLiveTick(tick uint32) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(LiveTick))
+	binary.LittleEndian.PutUint32(c[2:], tick)
+	return c
+}
+
+// EncodeSetName encodes the fixed part of SetName, name is it's payload and must be valid according to [ValidName].
+func EncodeSetName(name string) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(SetName))
+	c[2] = uint8(len(name))
+	return c
+}
+
+func EncodeSetReady(ready bool) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(SetReady))
+	if ready {
+		c[2] = 1
+	}
+	return c
+}
+
+func EncodeRosterJoin(player uint32) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(RosterJoin))
+	binary.LittleEndian.PutUint32(c[2:], player)
+	return c
+}
+
+func EncodeRosterLeave(player uint32) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(RosterLeave))
+	binary.LittleEndian.PutUint32(c[2:], player)
+	return c
+}
+
+// EncodeRosterUpdate encodes the fixed part of RosterUpdate, name is it's payload and must be valid according to [ValidName].
+func EncodeRosterUpdate(player uint32, ready bool, name string) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(RosterUpdate))
+	binary.LittleEndian.PutUint32(c[2:], player)
+	if ready {
+		c[6] = 1
+	}
+	c[7] = uint8(len(name))
+	return c
+}
+
+func EncodeGameStart() Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(GameStart))
+	return c
+}
+
+// EncodeKicked tells a client the host removed it from the game and it must not reconnect.
+func EncodeKicked(banned bool) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(Kicked))
+	if banned {
+		c[2] = 1
+	}
+	return c
+}
+
+// EncodeLeave tells the server we are leaving the game, it disconnects us right away instead of waiting for us to time out.
+func EncodeLeave() Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(Leave))
+	return c
+}
+
+// EncodeHostLeaving tells a client the host is shutting down and it must not reconnect.
+func EncodeHostLeaving() Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(HostLeaving))
+	return c
+}
+
+// ValidName returns an error if name can't be used as a player name.
+func ValidName(name string) error {
+	if len(name) > MaxNameSize {
+		return fmt.Errorf("name is %d bytes long, the maximum is %d", len(name), MaxNameSize)
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("name is not valid UTF-8")
+	}
+	if strings.IndexByte(name, 0) >= 0 {
+		return fmt.Errorf("name contains a zero byte")
+	}
+	return nil
+}
+
+// MaxChatSize is the longest chat message in bytes.
+const MaxChatSize = math.MaxUint8
+
+// EncodeChat encodes the fixed part of a chat message, text is it's payload.
+// callout is zero for free text, else it is a quick callout the frontend knows how to display and text is optional.
+// callout and text must be valid according to [ValidChat].
+func EncodeChat(callout uint8, text []byte) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(Chat))
+	c[2] = callout
+	c[3] = uint8(len(text))
+	return c
+}
+
+// EncodeChatMessage encodes the fixed part of a chat message relayed from player, text is it's payload.
+func EncodeChatMessage(player uint32, callout uint8, text []byte) Command {
+	var c Command
+	binary.LittleEndian.PutUint16(c[:], uint16(ChatMessage))
+	binary.LittleEndian.PutUint32(c[2:], player)
+	c[6] = callout
+	c[7] = uint8(len(text))
+	return c
+}
+
+// ValidChat returns an error if a chat message can't be sent.
+func ValidChat(callout uint8, text []byte) error {
+	if len(text) > MaxChatSize {
+		return fmt.Errorf("message is %d bytes long, the maximum is %d", len(text), MaxChatSize)
+	}
+	if callout == 0 && len(text) == 0 {
+		return fmt.Errorf("empty message")
+	}
+	if !utf8.Valid(text) {
+		return fmt.Errorf("message is not valid UTF-8")
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package rpcrender
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+
+	"github.com/Jorropo/OpenAirways/rollback"
+	rpcgame "github.com/Jorropo/OpenAirways/rpc/game"
+	"github.com/Jorropo/OpenAirways/state"
+)
+
+// Renderer writes the game to w using the RPC protocol the zig client reads.
+// It must not be used concurrently.
+type Renderer struct {
+	w           io.Writer
+	hasDoneInit bool
+	sendReuse   []byte
+	oldCamera   state.Rect
+}
+
+func New(w io.Writer) *Renderer {
+	return &Renderer{w: w}
+}
+
+// Render sends the state to zig, unlock is called once s is no longer used.
+func (r *Renderer) Render(s *state.State, unlock func()) {
+	content := r.sendReuse[:0]
+	if !r.hasDoneInit {
+		r.hasDoneInit = true
+		// Send game init packet
+		size := 2 + // OpCode
+			4 + // TickRate
+			1 + // SubPixel
+			4 + // speed
+			4*4 + // map size
+			4*4 + // visible map area
+			1 + // len(Runways)
+			(1+ // id
+				4*2+ // pos
+				2)* // heading
+				uint(len(s.Runways))
+
+		content = makeBuffer(content, size)
+		b := content
+		b = u16(b, uint16(rpcgame.GameInit))
+		b = u32(b, uint32(state.TickRate))
+		b[0] = state.SubPixel
+		b = b[1:]
+		b = u32(b, uint32(state.Speed))
+		b = rect(b, s.MapSize)
+		b = rect(b, s.CameraSize)
+		b[0] = uint8(len(s.Runways))
+		b = b[1:]
+		for _, a := range s.Runways {
+			b[0] = a.ID
+			b = b[1:]
+			b = v2(b, a.Pos)
+			b = u16(b, uint16(a.Heading))
+		}
+
+		r.oldCamera = s.CameraSize
+	}
+
+	size := 2 + // OpCode
+		4 + // Now
+		4 + // len(Planes)
+		(4+ // id
+			4*2+ // pos
+			2+ // wantHeading
+			2+ // heading
+			4)* // owner
+			uint(len(s.Planes))
+	content, b := appendNewBufferAfter(content, size)
+
+	b = u16(b, uint16(rpcgame.StateUpdate))
+	b = u32(b, uint32(s.Now))
+	b = u32(b, uint32(len(s.Planes)))
+	for _, p := range s.Planes {
+		b = u32(b, p.ID)
+		pos, heading := p.Position(s.Now)
+		b = v2(b, pos)
+		b = u16(b, uint16(p.WantHeading))
+		b = u16(b, uint16(heading))
+		b = u32(b, p.Owner)
+	}
+
+	if r.oldCamera != s.CameraSize {
+		r.oldCamera = s.CameraSize
+		content, b = appendNewBufferAfter(b, 18)
+		b = u16(b, uint16(rpcgame.MapResize))
+		b = rect(b, r.oldCamera)
+	}
+	unlock()
+
+	r.sendReuse = content
+	r.write(content)
+}
+
+// Mispredicted tells zig an optimistic command was discarded.
+func (r *Renderer) Mispredicted(c rollback.Command) {
+	op := c.Op.Bytes()
+	b := make([]byte, 2+4, 2+4+len(op))
+	u32(u16(b, uint16(rpcgame.Mispredicted)), uint32(c.HappendAt))
+	b = append(b, op...)
+	r.write(b)
+}
+
+// Roster forwards a roster change or the game starting to zig, the opcodes are the same.
+func (r *Renderer) Roster(c rpcgame.Command, name string) {
+	r.write(append(c.Bytes(), name...))
+}
+
+// Disconnected forwards us being kicked or the host leaving to zig, the opcodes are the same.
+func (r *Renderer) Disconnected(c rpcgame.Command) {
+	r.write(c.Bytes())
+}
+
+// Chat forwards a chat message to zig.
+func (r *Renderer) Chat(player uint32, callout uint8, text []byte) {
+	c := rpcgame.EncodeChatMessage(player, callout, text)
+	r.write(append(c.Bytes(), text...))
+}
+
+// Reconnecting tells zig we lost the server and are trying to connect again.
+func (r *Renderer) Reconnecting(attempt uint32) {
+	var b [2 + 4]byte
+	u32(u16(b[:], uint16(rpcgame.Reconnecting)), attempt)
+	r.write(b[:])
+}
+
+func (r *Renderer) write(b []byte) {
+	_, err := r.w.Write(b)
+	if err != nil {
+		log.Fatalf("writing to zig client: %s", err)
+	}
+}
+
+func u8(b []byte, x uint16) []byte {
+	binary.LittleEndian.PutUint16(b, x)
+	return b[2:]
+}
+
+func u16(b []byte, x uint16) []byte {
+	binary.LittleEndian.PutUint16(b, x)
+	return b[2:]
+}
+
+func u32(b []byte, x uint32) []byte {
+	binary.LittleEndian.PutUint32(b, x)
+	return b[4:]
+}
+
+func v2(b []byte, v state.V2) []byte {
+	_ = b[:8]
+	binary.LittleEndian.PutUint32(b, uint32(v.X))
+	binary.LittleEndian.PutUint32(b[4:], uint32(v.Y))
+	return b[8:]
+}
+
+func rect(b []byte, r state.Rect) []byte {
+	_ = b[:16]
+	binary.LittleEndian.PutUint32(b, uint32(r.X))
+	binary.LittleEndian.PutUint32(b[4:], uint32(r.Y))
+	binary.LittleEndian.PutUint32(b[8:], uint32(r.W))
+	binary.LittleEndian.PutUint32(b[12:], uint32(r.H))
+	return b[16:]
+}
+
+func makeBuffer(buf []byte, length uint) []byte {
+	if uint(cap(buf)) < length {
+		return append(buf[:cap(buf)], make([]byte, length-uint(cap(buf)))...)
+	}
+	return buf[:length]
+}
+
+func appendNewBufferAfter(b []byte, length uint) (total, new []byte) {
+	total = append(b, make([]byte, length)...)
+	new = total[len(b):]
+	return
+}
@@ -2,7 +2,9 @@ package state
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -20,8 +22,26 @@ const (
 	turnRate       = Tau / 10 / TickRate            // Rot16 / 10s / tickRate gives turn rate per tick
 	turnPerimeter  = Tau / turnRate * Speed         // how long a complete 360° turn would be
 	turnRadius     = turnPerimeter / (2 * math.Pi)  // the length between the center of the turn circle and the plane
+	spawnInterval  = TickRate * 5                   // testing traffic
+	maxPlanes      = 2                              // testing traffic
 )
 
+// FormatVersion is the version of the wire binary representation of [State], it must be bumped when it changes.
+const FormatVersion = 1
+
+// rulesRevision must be bumped when the simulation changes in a way the constants hashed in [RulesHash] don't capture, like [State.Apply] doing something new.
+const rulesRevision = 1
+
+// RulesHash identifies the simulation rules, peers must agree on it to get the same result out of the same commands.
+var RulesHash = func() uint64 {
+	var b []byte
+	for _, x := range [...]uint64{rulesRevision, SubPixel, TickRate, Speed, turnRate, spawnInterval, maxPlanes} {
+		b = binary.LittleEndian.AppendUint64(b, x)
+	}
+	h := sha256.Sum256(b)
+	return binary.LittleEndian.Uint64(h[:])
+}()
+
 type Time uint32
 
 // FIXME: completely move theses away
@@ -42,6 +62,8 @@ type Plane struct {
 	time                 Time // last time position was materialized
 	pos                  V2
 	WantHeading, heading Rot16
+	CommandedBy          uint32 // player who last gave it a heading, zero (the host) until then
+	Owner                uint32 // player controlling it, only used when [State.Controllers] is not empty
 }
 
 func (p *Plane) flyingStraight() bool {
@@ -94,9 +116,10 @@ func (p *Plane) tick(now Time) {
 	}
 }
 
-func (p *Plane) Turn(now Time, heading Rot16) {
+func (p *Plane) Turn(now Time, player uint32, heading Rot16) {
 	p.pos, p.heading = p.Position(now)
 	p.WantHeading = heading
+	p.CommandedBy = player
 	p.time = now
 }
 
@@ -113,16 +136,61 @@ type State struct {
 	Runways     []Runway
 	MapSize     Rect
 	CameraSize  Rect
+
+	// Pausing is set by a Pause command, the game freezes once Now reaches PauseAt until a Resume command clears it.
+	// Peers must not tick a [State.Frozen] state.
+	Pausing bool
+	PauseAt Time
+
+	// Controllers are the players planes are split between, sorted by id.
+	// When it is not empty only a plane's owner can command it, new planes are assigned round robin.
+	Controllers []uint32
+}
+
+// Frozen returns true if the game is paused, it stays on this tick until it is resumed.
+func (s *State) Frozen() bool {
+	return s.Pausing && s.Now >= s.PauseAt
+}
+
+// Controls returns true if player is allowed to command p.
+func (s *State) Controls(player uint32, p *Plane) bool {
+	return len(s.Controllers) == 0 || p.Owner == player
+}
+
+// assignOwner returns who controls the plane with this id when it spawns or it's owner stops controlling.
+func (s *State) assignOwner(id uint32) uint32 {
+	if len(s.Controllers) == 0 {
+		return 0
+	}
+	return s.Controllers[id%uint32(len(s.Controllers))]
+}
+
+func (s *State) plane(id uint32) *Plane {
+	i, ok := slices.BinarySearchFunc(s.Planes, id, func(p Plane, id uint32) int {
+		other := p.ID
+		if other < id {
+			return -1
+		}
+		if other == id {
+			return 0
+		}
+		return 1
+	})
+	if !ok {
+		return nil
+	}
+	return &s.Planes[i]
 }
 
 func (s *State) Tick() {
 	s.Now++
 
 	// generating some traffic for testing purposes
-	if s.Now%(TickRate*5) == 1 && len(s.Planes) < 2 {
+	if s.Now%spawnInterval == 1 && len(s.Planes) < maxPlanes {
 		s.Planes = append(s.Planes, Plane{
-			ID:   s.nextPlaneId,
-			time: s.Now,
+			ID:    s.nextPlaneId,
+			time:  s.Now,
+			Owner: s.assignOwner(s.nextPlaneId),
 		})
 		s.nextPlaneId++
 	}
@@ -132,7 +200,8 @@ func (s *State) Tick() {
 	}
 }
 
-func (s *State) Apply(c rpcgame.Command) {
+// Apply applies c sent by player, the player is stamped by the server so it can be trusted for attribution.
+func (s *State) Apply(player uint32, c rpcgame.Command) {
 	b := c[:]
 	op := rpcgame.OpCode(binary.LittleEndian.Uint16(b))
 	b = b[2:]
@@ -140,36 +209,129 @@ func (s *State) Apply(c rpcgame.Command) {
 	case rpcgame.GivePlaneHeading:
 		id := binary.LittleEndian.Uint32(b)
 		heading := Rot16(binary.LittleEndian.Uint16(b[4:]))
-		i, ok := slices.BinarySearchFunc(s.Planes, id, func(p Plane, id uint32) int {
-			other := p.ID
-			if other < id {
-				return -1
-			}
-			if other == id {
-				return 0
-			}
-			return 1
-		})
-		if ok {
-			s.Planes[i].Turn(s.Now, heading)
-		} else {
+		p := s.plane(id)
+		if p == nil {
 			// probably the user giving orders to a plane that just landed or left the map
 			log.Println("got GivePlaneHeading for missing plane:", id)
+			return
+		}
+		if !s.Controls(player, p) {
+			// probably racing with a handoff, every peer ignores it on the same tick so it rolls back like any other command.
+			return
+		}
+		p.Turn(s.Now, player, heading)
+	case rpcgame.Handoff:
+		id := binary.LittleEndian.Uint32(b)
+		to := binary.LittleEndian.Uint32(b[4:])
+		p := s.plane(id)
+		if p == nil || !s.Controls(player, p) {
+			return // gone, or already handed off.
+		}
+		if _, ok := slices.BinarySearch(s.Controllers, to); !ok {
+			return // they left in the meantime.
+		}
+		p.Owner = to
+	case rpcgame.SetController:
+		id := binary.LittleEndian.Uint32(b)
+		i, ok := slices.BinarySearch(s.Controllers, id)
+		if b[4] != 0 {
+			if !ok {
+				s.Controllers = slices.Insert(s.Controllers, i, id)
+			}
+			return
 		}
+		if !ok {
+			return
+		}
+		s.Controllers = slices.Delete(s.Controllers, i, i+1)
+		// their planes are split between the remaining controllers.
+		for i := range s.Planes {
+			if p := &s.Planes[i]; p.Owner == id {
+				p.Owner = s.assignOwner(p.ID)
+			}
+		}
+	case rpcgame.Pause:
+		at := Time(binary.LittleEndian.Uint32(b))
+		if s.Pausing || at < s.Now {
+			return // already pausing, or it missed it's tick which netcode does not let through.
+		}
+		s.Pausing = true
+		s.PauseAt = at
+	case rpcgame.Resume:
+		// the delay is only used by netcode to restart everyone together.
+		s.Pausing = false
 	default:
 		log.Fatalf("got invalid opcode: %v", op)
 	}
 }
 
+// ErrNotOwner is returned by [State.Validate] for commands about a plane someone else controls.
+var ErrNotOwner = errors.New("the plane is controlled by someone else")
+
+// Validate checks that c sent by player for tick at makes sense for s, it is used to reject commands from misbehaving peers before they reach [State.Apply].
+// at can be in s's future when player runs ahead of us, planes which may spawn until then are accepted.
+// Planes which existed but are gone are accepted since players can race with planes leaving.
+// Commands for planes player does not control in s return an error wrapping [ErrNotOwner], the caller decides if they could race with a handoff between s and at.
+// Headings are [Rot16] so all values are in range.
+func (s *State) Validate(at Time, player uint32, c rpcgame.Command) error {
+	planes := s.nextPlaneId
+	if at > s.Now {
+		planes += spawnsUntil(at) - spawnsUntil(s.Now)
+	}
+	switch op := c.OpCode(); op {
+	case rpcgame.GivePlaneHeading:
+		id := binary.LittleEndian.Uint32(c[2:])
+		if id >= planes {
+			return fmt.Errorf("GivePlaneHeading for plane %d which never existed", id)
+		}
+		if p := s.plane(id); p != nil && !s.Controls(player, p) {
+			return fmt.Errorf("GivePlaneHeading for plane %d: %w", id, ErrNotOwner)
+		}
+		return nil
+	case rpcgame.Handoff:
+		id := binary.LittleEndian.Uint32(c[2:])
+		if id >= planes {
+			return fmt.Errorf("Handoff for plane %d which never existed", id)
+		}
+		if len(s.Controllers) == 0 {
+			return fmt.Errorf("Handoff while planes are not owned")
+		}
+		if p := s.plane(id); p != nil && !s.Controls(player, p) {
+			return fmt.Errorf("Handoff for plane %d: %w", id, ErrNotOwner)
+		}
+		return nil
+	case rpcgame.SetController:
+		if player != 0 {
+			return fmt.Errorf("SetController is only sent by the host")
+		}
+		if c[6] > 1 {
+			return fmt.Errorf("invalid controller state: %d", c[6])
+		}
+		return nil
+	case rpcgame.Pause, rpcgame.Resume:
+		return nil
+	default:
+		return fmt.Errorf("%v is not a game command", op)
+	}
+}
+
+// spawnsUntil returns how many times [State.Tick] tried to spawn a plane from the start of the game up to tick t included.
+func spawnsUntil(t Time) uint32 {
+	return uint32((uint64(t) + spawnInterval - 1) / spawnInterval)
+}
+
 // Copy copies o into s reusing s's storage
 func (s *State) Copy(o *State) {
 	*s = State{
 		Now:         o.Now,
+		Pausing:     o.Pausing,
+		PauseAt:     o.PauseAt,
 		nextPlaneId: o.nextPlaneId,
 		Planes:      append(s.Planes[:0], o.Planes...),
 		Runways:     append(s.Runways[:0], o.Runways...),
 		MapSize:     o.MapSize,
 		CameraSize:  o.CameraSize,
+		Controllers: append(s.Controllers[:0], o.Controllers...),
 	}
 }
 
@@ -186,6 +348,9 @@ func (s *State) Read(r io.Reader) (red uint, err error) {
 	s.nextPlaneId = binary.LittleEndian.Uint32(b[4:])
 	nPlanes := binary.LittleEndian.Uint32(b[8:])
 	nRunways := binary.LittleEndian.Uint32(b[12:])
+	s.Pausing = b[16] != 0
+	s.PauseAt = Time(binary.LittleEndian.Uint32(b[17:]))
+	nControllers := binary.LittleEndian.Uint32(b[21:])
 
 	s.Planes = slices.Grow(s.Planes[:0], int(nPlanes))
 	for range nPlanes {
@@ -200,6 +365,8 @@ func (s *State) Read(r io.Reader) (red uint, err error) {
 			pos:         V2{int32(binary.LittleEndian.Uint32(b[8:])), int32(binary.LittleEndian.Uint32(b[12:]))},
 			WantHeading: Rot16(binary.LittleEndian.Uint16(b[16:])),
 			heading:     Rot16(binary.LittleEndian.Uint16(b[18:])),
+			CommandedBy: binary.LittleEndian.Uint32(b[20:]),
+			Owner:       binary.LittleEndian.Uint32(b[24:]),
 		})
 	}
 
@@ -217,6 +384,16 @@ func (s *State) Read(r io.Reader) (red uint, err error) {
 		})
 	}
 
+	s.Controllers = slices.Grow(s.Controllers[:0], int(nControllers))
+	for range nControllers {
+		n, err = io.ReadFull(r, b[:4])
+		red += uint(n)
+		if err != nil {
+			return red, fmt.Errorf("reading Controller: %w", err)
+		}
+		s.Controllers = append(s.Controllers, binary.LittleEndian.Uint32(b[:]))
+	}
+
 	return red, nil
 }
 
@@ -234,14 +411,19 @@ func (s *State) UnmarshalBinary(b []byte) error {
 const headerSize = 4 + // Now
 	4 + // nextPlaneId
 	4 + // len(Planes)
-	4 // len(Runways)
+	4 + // len(Runways)
+	1 + // pausing
+	4 + // pauseAt
+	4 // len(Controllers)
 
 const planeSize = 4 + // id
 	4 + // now (last materialized time)
 	4 + // x
 	4 + // y
 	2 + // wantHeading
-	2 // heading
+	2 + // heading
+	4 + // commandedBy
+	4 // owner
 
 const runwaySize = 1 + // id
 	4*2 + // pos
@@ -249,7 +431,7 @@ const runwaySize = 1 + // id
 
 // AppendMarshalBinary appends the wire binary representation of s to in and returns the result.
 func (s *State) AppendMarshalBinary(in []byte) []byte {
-	size := headerSize + planeSize*len(s.Planes) + runwaySize*len(s.Runways)
+	size := headerSize + planeSize*len(s.Planes) + runwaySize*len(s.Runways) + 4*len(s.Controllers)
 	r := append(in, make([]byte, size)...)
 	b := r[len(in):]
 
@@ -257,6 +439,11 @@ func (s *State) AppendMarshalBinary(in []byte) []byte {
 	b = u32(b, uint32(s.nextPlaneId))
 	b = u32(b, uint32(len(s.Planes)))
 	b = u32(b, uint32(len(s.Runways)))
+	if s.Pausing {
+		b[0] = 1
+	}
+	b = u32(b[1:], uint32(s.PauseAt))
+	b = u32(b, uint32(len(s.Controllers)))
 
 	for _, p := range s.Planes {
 		b = u32(b, p.ID)
@@ -265,6 +452,8 @@ func (s *State) AppendMarshalBinary(in []byte) []byte {
 		b = u32(b, uint32(p.pos.Y))
 		b = u16(b, uint16(p.WantHeading))
 		b = u16(b, uint16(p.heading))
+		b = u32(b, p.CommandedBy)
+		b = u32(b, p.Owner)
 	}
 
 	for _, r := range s.Runways {
@@ -275,6 +464,10 @@ func (s *State) AppendMarshalBinary(in []byte) []byte {
 		b = u16(b, uint16(r.Heading))
 	}
 
+	for _, c := range s.Controllers {
+		b = u32(b, c)
+	}
+
 	if len(b) != 0 {
 		panic("State marshal logic error, didn't consumed all the buffer")
 	}